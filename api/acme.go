@@ -0,0 +1,717 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//ACME challenge types we can answer
+const (
+	ACMEChallengeHTTP01    = "http-01"     //served on the plain HTTP port
+	ACMEChallengeTLSALPN01 = "tls-alpn-01" //served on the HTTPS port
+)
+
+//Let's Encrypt's production directory
+const DefaultACMEDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+
+//Certificates are renewed once they have less than this left
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+//How often the certificate is checked for renewal, and how long to wait after a failed attempt
+const (
+	acmeCheckInterval = 12 * time.Hour
+	acmeRetryInterval = 10 * time.Minute
+)
+
+//How long to wait for the CA to validate a challenge or issue a certificate
+const acmePollTimeout = 2 * time.Minute
+
+//How long a single request to the CA may take, so a stalled CA can't hold up renewal forever
+const acmeRequestTimeout = 30 * time.Second
+
+//ALPN protocol the CA negotiates for TLS-ALPN-01 (RFC 8737)
+const acmeTLSALPNProto = "acme-tls/1"
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+//id-pe-acmeIdentifier, carried by TLS-ALPN-01 challenge certificates
+var oidACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+var ErrNoACMECertificate error = errors.New("no certificate has been obtained from the ACME CA yet")
+var ErrACMETermsNotAccepted error = errors.New("acme: the CA's terms of service must be accepted")
+
+//Settings for obtaining certificates from an ACME CA
+type ACMEConfig struct {
+	Directory string       //directory URL of the CA
+	Domains   []string     //names the certificate must cover. The first is also its common name
+	Email     string       //contact address for the account. Optional
+	CacheDir  string       //where the account key and certificates are kept across restarts
+	Challenge string       //ACMEChallengeHTTP01 or ACMEChallengeTLSALPN01
+	AcceptTOS bool         //the operator has agreed to the CA's terms of service. Required
+	Client    *http.Client //for talking to the CA. If nil, a client with a timeout of acmeRequestTimeout is used
+}
+
+//Error document returned by an ACME CA (RFC 7807)
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+//Minimal ACME (RFC 8555) client. Requests are signed with an ES256 account key
+type acmeClient struct {
+	ctx  context.Context //cancels requests and polling
+	http *http.Client
+	dir  struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+	key    *ecdsa.PrivateKey
+	kid    string //account URL, once registered
+	nonces []string
+	lock   sync.Mutex //guards nonces
+}
+
+func newACMEClient(ctx context.Context, directory string, hc *http.Client, key *ecdsa.PrivateKey) (*acmeClient, error) {
+	c := &acmeClient{ctx: ctx, http: hc, key: key}
+	resp, err := c.do("GET", directory, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("acme: directory %s responded with status %d", directory, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c.dir); err != nil {
+		return nil, err
+	}
+	if c.dir.NewNonce == "" || c.dir.NewAccount == "" || c.dir.NewOrder == "" {
+		return nil, fmt.Errorf("acme: directory %s is incomplete", directory)
+	}
+	return c, nil
+}
+
+//Makes a request that's abandoned once c.ctx is done
+func (c *acmeClient) do(method, url, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return c.http.Do(req.WithContext(c.ctx))
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+//Public account key as a JWK, with members in the order RFC 7638 thumbprints need
+func (c *acmeClient) jwk() string {
+	size := (c.key.Curve.Params().BitSize + 7) / 8
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, b64(c.key.X.FillBytes(make([]byte, size))), b64(c.key.Y.FillBytes(make([]byte, size))))
+}
+
+//Key authorization for a challenge token
+func (c *acmeClient) keyAuthorization(token string) string {
+	sum := sha256.Sum256([]byte(c.jwk()))
+	return token + "." + b64(sum[:])
+}
+
+func (c *acmeClient) nonce() (string, error) {
+	c.lock.Lock()
+	if n := len(c.nonces); n > 0 {
+		nonce := c.nonces[n-1]
+		c.nonces = c.nonces[:n-1]
+		c.lock.Unlock()
+		return nonce, nil
+	}
+	c.lock.Unlock()
+	resp, err := c.do("HEAD", c.dir.NewNonce, "", nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("acme: CA didn't provide a nonce")
+	}
+	return nonce, nil
+}
+
+//Signs payload for url as a flattened JWS. A nil payload makes a POST-as-GET request
+func (c *acmeClient) sign(url string, payload []byte) ([]byte, error) {
+	nonce, err := c.nonce()
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf(`"kid":%q`, c.kid)
+	if c.kid == "" {
+		key = `"jwk":` + c.jwk()
+	}
+	protected := b64([]byte(fmt.Sprintf(`{"alg":"ES256",%s,"nonce":%q,"url":%q}`, key, nonce, url)))
+	encoded := ""
+	if payload != nil {
+		encoded = b64(payload)
+	}
+	digest := sha256.Sum256([]byte(protected + "." + encoded))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return json.Marshal(map[string]string{"protected": protected, "payload": encoded, "signature": b64(sig)})
+}
+
+//Makes a signed request, decoding a JSON response into out if it isn't nil. A nil payload makes a POST-as-GET request
+//
+//Returns the response headers and body. A request rejected for a stale nonce is retried once
+func (c *acmeClient) post(url string, payload interface{}, out interface{}) (http.Header, []byte, error) {
+	var raw []byte
+	if payload != nil {
+		var err error
+		if raw, err = json.Marshal(payload); err != nil {
+			return nil, nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		body, err := c.sign(url, raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := c.do("POST", url, "application/jose+json", body)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+			c.lock.Lock()
+			c.nonces = append(c.nonces, nonce)
+			c.lock.Unlock()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode >= 400 {
+			p := &acmeProblem{}
+			if json.Unmarshal(data, p) != nil || p.Type == "" {
+				p.Type, p.Detail = "error", fmt.Sprintf("%s responded with status %d", url, resp.StatusCode)
+			}
+			if p.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+				continue
+			}
+			return nil, nil, p
+		}
+		if out != nil {
+			if err := json.Unmarshal(data, out); err != nil {
+				return nil, nil, err
+			}
+		}
+		return resp.Header, data, nil
+	}
+}
+
+//Creates the account, or looks up the existing one for our key. agreed is whether the operator accepted the CA's terms
+func (c *acmeClient) register(email string, agreed bool) error {
+	req := map[string]interface{}{"termsOfServiceAgreed": agreed}
+	if email != "" {
+		req["contact"] = []string{"mailto:" + email}
+	}
+	h, _, err := c.post(c.dir.NewAccount, req, nil)
+	if err != nil {
+		return err
+	}
+	if c.kid = h.Get("Location"); c.kid == "" {
+		return errors.New("acme: CA didn't provide an account URL")
+	}
+	return nil
+}
+
+//Fetches url with POST-as-GET until its status is no longer one of pending, waiting between attempts
+//
+//Gives up as soon as c.ctx is done
+func (c *acmeClient) poll(url string, out interface{}, status func() string, pending ...string) error {
+	deadline := time.Now().Add(acmePollTimeout)
+	for {
+		h, _, err := c.post(url, nil, out)
+		if err != nil {
+			return err
+		}
+		still := false
+		for _, p := range pending {
+			still = still || status() == p
+		}
+		if !still {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("acme: %s still %s after %s", url, status(), acmePollTimeout)
+		}
+		wait := time.Second
+		if secs, err := strconv.Atoi(h.Get("Retry-After")); err == nil && secs > 0 && secs < 60 {
+			wait = time.Duration(secs) * time.Second
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-c.ctx.Done():
+			t.Stop()
+			return c.ctx.Err()
+		}
+	}
+}
+
+//Orders a certificate for domains, answering each authorization's challenge of type challenge via respond
+//
+//respond makes the key authorization for a token available to the CA and returns a function withdrawing it.
+//Returns the DER encoded chain, leaf first, and its private key
+func (c *acmeClient) obtain(domains []string, challenge string, respond func(domain, token, keyAuth string) (func(), error)) ([][]byte, *ecdsa.PrivateKey, error) {
+	ids := make([]map[string]string, len(domains))
+	for i, d := range domains {
+		ids[i] = map[string]string{"type": "dns", "value": d}
+	}
+	var order acmeOrder
+	h, _, err := c.post(c.dir.NewOrder, map[string]interface{}{"identifiers": ids}, &order)
+	if err != nil {
+		return nil, nil, err
+	}
+	orderURL := h.Get("Location")
+	for _, authzURL := range order.Authorizations {
+		var authz acmeAuthorization
+		if _, _, err := c.post(authzURL, nil, &authz); err != nil {
+			return nil, nil, err
+		}
+		if authz.Status == "valid" {
+			continue
+		}
+		var chal *acmeChallenge
+		for i := range authz.Challenges {
+			if authz.Challenges[i].Type == challenge {
+				chal = &authz.Challenges[i]
+			}
+		}
+		if chal == nil {
+			return nil, nil, fmt.Errorf("acme: CA doesn't offer %s for %s", challenge, authz.Identifier.Value)
+		}
+		withdraw, err := respond(authz.Identifier.Value, chal.Token, c.keyAuthorization(chal.Token))
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, _, err = c.post(chal.URL, struct{}{}, nil); err == nil {
+			err = c.poll(authzURL, &authz, func() string { return authz.Status }, "pending")
+		}
+		withdraw()
+		if err != nil {
+			return nil, nil, err
+		}
+		if authz.Status != "valid" {
+			for _, ch := range authz.Challenges {
+				if ch.Type == challenge && ch.Error != nil {
+					return nil, nil, fmt.Errorf("acme: %s failed for %s: %s", challenge, authz.Identifier.Value, ch.Error.Error())
+				}
+			}
+			return nil, nil, fmt.Errorf("acme: authorization for %s is %s", authz.Identifier.Value, authz.Status)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := c.post(order.Finalize, map[string]string{"csr": b64(csr)}, &order); err != nil {
+		return nil, nil, err
+	}
+	if order.Status != "valid" {
+		if err := c.poll(orderURL, &order, func() string { return order.Status }, "pending", "ready", "processing"); err != nil {
+			return nil, nil, err
+		}
+	}
+	if order.Status != "valid" || order.Certificate == "" {
+		return nil, nil, fmt.Errorf("acme: order for %s is %s", strings.Join(domains, ", "), order.Status)
+	}
+	_, data, err := c.post(order.Certificate, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var chain [][]byte
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, nil, errors.New("acme: CA returned no certificates")
+	}
+	return chain, key, nil
+}
+
+//Self-signed certificate proving control of domain for TLS-ALPN-01
+func tlsALPNCert(domain, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	ext, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		Subject:         pkix.Name{CommonName: domain},
+		DNSNames:        []string{domain},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: oidACMEIdentifier, Critical: true, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+//Obtains and renews the HTTPS certificate from an ACME CA instead of reading it from files
+//
+//The account key and current certificate are cached on disk, so restarts don't request new certificates.
+//Renewal runs in the background once less than acmeRenewBefore is left, and the old certificate is served until
+//the new one is issued
+type ACMEManager struct {
+	reloads uint64                      //certificates obtained or loaded from the cache. Accessed atomically, so kept first for alignment
+	cfg     ACMEConfig                  //
+	cert    atomic.Value                //*tls.Certificate with Leaf set, once one has been obtained
+	lastErr atomic.Value                //string. Why the most recent attempt failed, or empty
+	tokens  map[string]string           //HTTP-01 token -> key authorization
+	alpn    map[string]*tls.Certificate //TLS-ALPN-01 domain -> challenge certificate
+	lock    sync.Mutex                  //guards tokens and alpn
+	check   chan struct{}               //requests an immediate renewal check
+	ctx     context.Context             //done once closed, abandoning any request to the CA
+	stop    context.CancelFunc          //
+	wg      sync.WaitGroup
+}
+
+//Creates a manager for cfg, loading a cached certificate if there is a usable one
+//
+//Nothing is requested from the CA until Start, since the CA has to reach our listeners to validate challenges
+func NewACMEManager(cfg ACMEConfig) (*ACMEManager, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, errors.New("acme: at least one domain is needed")
+	}
+	if cfg.Challenge != ACMEChallengeHTTP01 && cfg.Challenge != ACMEChallengeTLSALPN01 {
+		return nil, fmt.Errorf("acme: challenge must be '%s' or '%s'", ACMEChallengeHTTP01, ACMEChallengeTLSALPN01)
+	}
+	if !cfg.AcceptTOS {
+		return nil, ErrACMETermsNotAccepted
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: acmeRequestTimeout}
+	}
+	if err := os.MkdirAll(cfg.CacheDir, 0700); err != nil {
+		return nil, err
+	}
+	m := &ACMEManager{cfg: cfg}
+	m.lastErr.Store("")
+	m.tokens = make(map[string]string)
+	m.alpn = make(map[string]*tls.Certificate)
+	m.check = make(chan struct{}, 1)
+	m.ctx, m.stop = context.WithCancel(context.Background())
+	if cert, err := loadKeyPair(m.certPath(), m.keyPath()); err == nil && m.covers(cert.Leaf) {
+		m.cert.Store(cert)
+		atomic.AddUint64(&m.reloads, 1)
+		infof("Loaded cached ACME certificate for %s, valid until %s", strings.Join(cfg.Domains, ", "), cert.Leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	return m, nil
+}
+
+func (m *ACMEManager) certPath() string {
+	return filepath.Join(m.cfg.CacheDir, m.cfg.Domains[0]+".crt")
+}
+
+func (m *ACMEManager) keyPath() string {
+	return filepath.Join(m.cfg.CacheDir, m.cfg.Domains[0]+".key")
+}
+
+//Whether leaf is valid for every configured domain
+func (m *ACMEManager) covers(leaf *x509.Certificate) bool {
+	for _, d := range m.cfg.Domains {
+		if leaf.VerifyHostname(d) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+//Starts obtaining and renewing the certificate in the background
+func (m *ACMEManager) Start() {
+	m.wg.Add(1)
+	go m.run()
+}
+
+func (m *ACMEManager) run() {
+	defer m.wg.Done()
+	for {
+		wait := acmeCheckInterval
+		if m.due() {
+			if err := m.obtain(); err != nil && m.ctx.Err() == nil {
+				m.lastErr.Store(err.Error())
+				log.Printf("Error: could not obtain certificate from %s, retrying in %s: %s", m.cfg.Directory, acmeRetryInterval, err.Error())
+				wait = acmeRetryInterval
+			}
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-m.check:
+			t.Stop()
+		case <-m.ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+//Whether there's no certificate yet or it needs renewing
+func (m *ACMEManager) due() bool {
+	cert, _ := m.cert.Load().(*tls.Certificate)
+	return cert == nil || time.Until(cert.Leaf.NotAfter) < acmeRenewBefore
+}
+
+//Loads the cached account key, generating one if there isn't any
+func (m *ACMEManager) accountKey() (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(m.cfg.CacheDir, "account.key")
+	if data, err := ioutil.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("acme: no PEM key found in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+//Writes data to path via a temporary file, so readers never see a partial file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+//Requests a new certificate, caches it and starts serving it
+func (m *ACMEManager) obtain() error {
+	key, err := m.accountKey()
+	if err != nil {
+		return err
+	}
+	c, err := newACMEClient(m.ctx, m.cfg.Directory, m.cfg.Client, key)
+	if err != nil {
+		return err
+	}
+	if err := c.register(m.cfg.Email, m.cfg.AcceptTOS); err != nil {
+		return err
+	}
+	infof("Requesting certificate for %s from %s", strings.Join(m.cfg.Domains, ", "), m.cfg.Directory)
+	chain, certKey, err := c.obtain(m.cfg.Domains, m.cfg.Challenge, m.respond)
+	if err != nil {
+		return err
+	}
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	if !m.covers(cert.Leaf) {
+		return fmt.Errorf("acme: issued certificate doesn't cover %s", strings.Join(m.cfg.Domains, ", "))
+	}
+	//key first, so a crash in between leaves a pair that fails to load rather than a mismatched one being served
+	if err := writeFileAtomic(m.keyPath(), keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(m.certPath(), certPEM, 0644); err != nil {
+		return err
+	}
+	m.cert.Store(&cert)
+	m.lastErr.Store("")
+	atomic.AddUint64(&m.reloads, 1)
+	infof("Obtained certificate for %s, valid until %s", strings.Join(m.cfg.Domains, ", "), cert.Leaf.NotAfter.UTC().Format(time.RFC3339))
+	return nil
+}
+
+//Makes a key authorization available to the CA until the returned function is called
+func (m *ACMEManager) respond(domain, token, keyAuth string) (func(), error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.cfg.Challenge == ACMEChallengeHTTP01 {
+		m.tokens[token] = keyAuth
+		return func() {
+			m.lock.Lock()
+			delete(m.tokens, token)
+			m.lock.Unlock()
+		}, nil
+	}
+	cert, err := tlsALPNCert(domain, keyAuth)
+	if err != nil {
+		return nil, err
+	}
+	m.alpn[domain] = cert
+	return func() {
+		m.lock.Lock()
+		delete(m.alpn, domain)
+		m.lock.Unlock()
+	}, nil
+}
+
+//For tls.Config.GetCertificate. Handshakes from the CA validating TLS-ALPN-01 get the challenge certificate
+func (m *ACMEManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acmeTLSALPNProto {
+		m.lock.Lock()
+		cert := m.alpn[hello.ServerName]
+		m.lock.Unlock()
+		if cert == nil {
+			return nil, fmt.Errorf("acme: no TLS-ALPN-01 challenge pending for %s", hello.ServerName)
+		}
+		return cert, nil
+	}
+	cert, _ := m.cert.Load().(*tls.Certificate)
+	if cert == nil {
+		return nil, ErrNoACMECertificate
+	}
+	return cert, nil
+}
+
+//Wraps the plain HTTP handler to answer HTTP-01 challenges
+func (m *ACMEManager) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		m.lock.Lock()
+		keyAuth, exists := m.tokens[strings.TrimPrefix(req.URL.Path, acmeChallengePath)]
+		m.lock.Unlock()
+		if !exists {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+//Checks whether the certificate is due for renewal straight away, rather than at the next scheduled check
+func (m *ACMEManager) Reload() error {
+	select {
+	case m.check <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+//Snapshot for GET /stats
+func (m *ACMEManager) Metrics() *CertMetrics {
+	metrics := &CertMetrics{Reloads: atomic.LoadUint64(&m.reloads), LastError: m.lastErr.Load().(string)}
+	if cert, _ := m.cert.Load().(*tls.Certificate); cert != nil {
+		metrics.NotAfter = cert.Leaf.NotAfter.UTC()
+		metrics.ExpiresIn = int64(time.Until(cert.Leaf.NotAfter).Seconds())
+	}
+	return metrics
+}
+
+//Stops renewing, abandoning any attempt in progress
+func (m *ACMEManager) Close() {
+	m.stop()
+	m.wg.Wait()
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//In-process stand-in for an ACME CA such as Pebble. It checks every JWS and really validates challenges against
+//httpAddr and tlsAddr, whatever domain they are for
+type fakeACME struct {
+	t         *testing.T
+	srv       *httptest.Server
+	ca        tls.Certificate
+	httpAddr  string //where http-01 challenges are fetched from
+	tlsAddr   string //where tls-alpn-01 challenges are dialled
+	badNonces int    //requests to reject with badNonce before accepting any
+	stall     bool   //leave challenges pending forever
+	lock      sync.Mutex
+	nonce     int
+	nonces    map[string]bool
+	accounts  map[string]*ecdsa.PublicKey //by account URL
+	authzs    map[string]*fakeAuthz
+	orders    map[string]*fakeOrder
+}
+
+type fakeAuthz struct {
+	account, domain, token, status string
+	err                            interface{} //problem document once validation failed
+}
+
+type fakeOrder struct {
+	account string
+	domains []string
+	authzs  []string
+	status  string
+	chain   []byte
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	f := &fakeACME{t: t}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	f.ca = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	f.nonces = make(map[string]bool)
+	f.accounts = make(map[string]*ecdsa.PublicKey)
+	f.authzs = make(map[string]*fakeAuthz)
+	f.orders = make(map[string]*fakeOrder)
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeACME) newNonce() string {
+	f.nonce++
+	n := fmt.Sprintf("nonce-%d", f.nonce)
+	f.nonces[n] = true
+	return n
+}
+
+func (f *fakeACME) problem(w http.ResponseWriter, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + typ, "detail": detail})
+}
+
+func (f *fakeACME) reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+//Checks the request's JWS, returning the account URL (or the new account's key) and the payload
+func (f *fakeACME) verify(req *http.Request) (string, *ecdsa.PublicKey, []byte, error) {
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(req.Body).Decode(&jws); err != nil {
+		return "", nil, nil, err
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var protected struct {
+		Alg, Kid, Nonce, URL string
+		JWK                  *struct{ Crv, Kty, X, Y string }
+	}
+	if err := json.Unmarshal(raw, &protected); err != nil {
+		return "", nil, nil, err
+	}
+	if protected.Alg != "ES256" || protected.URL != f.srv.URL+req.URL.Path {
+		return "", nil, nil, fmt.Errorf("bad protected header %s", raw)
+	}
+	if !f.nonces[protected.Nonce] {
+		return "", nil, nil, fmt.Errorf("badNonce")
+	}
+	delete(f.nonces, protected.Nonce)
+	if f.badNonces > 0 {
+		f.badNonces--
+		return "", nil, nil, fmt.Errorf("badNonce")
+	}
+	key := f.accounts[protected.Kid]
+	if protected.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(protected.JWK.Y)
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	}
+	if key == nil {
+		return "", nil, nil, fmt.Errorf("unknown account %s", protected.Kid)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return "", nil, nil, fmt.Errorf("bad signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return protected.Kid, key, payload, err
+}
+
+func (f *fakeACME) keyAuthorization(account, token string) string {
+	c := &acmeClient{key: &ecdsa.PrivateKey{PublicKey: *f.accounts[account]}}
+	return c.keyAuthorization(token)
+}
+
+func (f *fakeACME) validate(a *fakeAuthz, typ string) error {
+	keyAuth := f.keyAuthorization(a.account, a.token)
+	if typ == ACMEChallengeHTTP01 {
+		req, _ := http.NewRequest("GET", "http://"+f.httpAddr+acmeChallengePath+a.token, nil)
+		req.Host = a.domain
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != keyAuth {
+			return fmt.Errorf("got %d %q", resp.StatusCode, body)
+		}
+		return nil
+	}
+	conn, err := tls.Dial("tcp", f.tlsAddr, &tls.Config{ServerName: a.domain, NextProtos: []string{acmeTLSALPNProto}, InsecureSkipVerify: true})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	leaf := state.PeerCertificates[0]
+	if state.NegotiatedProtocol != acmeTLSALPNProto || len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != a.domain {
+		return fmt.Errorf("negotiated %q for %v", state.NegotiatedProtocol, leaf.DNSNames)
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	want, _ := asn1.Marshal(sum[:])
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(oidACMEIdentifier) && ext.Critical && bytes.Equal(ext.Value, want) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no matching acmeIdentifier extension")
+}
+
+func (f *fakeACME) orderJSON(id string) map[string]interface{} {
+	o := f.orders[id]
+	authzs := make([]string, len(o.authzs))
+	for i, a := range o.authzs {
+		authzs[i] = f.srv.URL + "/authz/" + a
+	}
+	return map[string]interface{}{
+		"status":         o.status,
+		"authorizations": authzs,
+		"finalize":       f.srv.URL + "/finalize/" + id,
+		"certificate":    f.srv.URL + "/cert/" + id,
+	}
+}
+
+func (f *fakeACME) serve(w http.ResponseWriter, req *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	w.Header().Set("Replay-Nonce", f.newNonce())
+	switch req.URL.Path {
+	case "/dir":
+		f.reply(w, http.StatusOK, map[string]string{
+			"newNonce":   f.srv.URL + "/nonce",
+			"newAccount": f.srv.URL + "/account",
+			"newOrder":   f.srv.URL + "/order",
+		})
+		return
+	case "/nonce":
+		return
+	}
+	account, key, payload, err := f.verify(req)
+	if err != nil {
+		if err.Error() == "badNonce" {
+			f.problem(w, "badNonce", "stale nonce")
+		} else {
+			f.problem(w, "malformed", err.Error())
+		}
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	id := ""
+	if len(parts) == 2 {
+		id = parts[1]
+	}
+	switch parts[0] {
+	case "account":
+		var newAccount struct {
+			TermsOfServiceAgreed bool
+		}
+		if json.Unmarshal(payload, &newAccount); !newAccount.TermsOfServiceAgreed {
+			f.problem(w, "userActionRequired", "terms of service not agreed")
+			return
+		}
+		x := key.X.Bytes()
+		url := fmt.Sprintf("%s/acct/%x", f.srv.URL, sha256.Sum256(x))
+		code := http.StatusOK
+		if f.accounts[url] == nil {
+			f.accounts[url], code = key, http.StatusCreated
+		}
+		w.Header().Set("Location", url)
+		f.reply(w, code, map[string]string{"status": "valid"})
+	case "order":
+		var newOrder struct {
+			Identifiers []struct{ Type, Value string }
+		}
+		json.Unmarshal(payload, &newOrder)
+		id := fmt.Sprintf("%d", len(f.orders)+1)
+		o := &fakeOrder{account: account, status: "pending"}
+		for i, ident := range newOrder.Identifiers {
+			aid := fmt.Sprintf("%s-%d", id, i)
+			f.authzs[aid] = &fakeAuthz{account: account, domain: ident.Value, token: fmt.Sprintf("token%s", aid), status: "pending"}
+			o.domains = append(o.domains, ident.Value)
+			o.authzs = append(o.authzs, aid)
+		}
+		f.orders[id] = o
+		w.Header().Set("Location", f.srv.URL+"/orders/"+id)
+		f.reply(w, http.StatusCreated, f.orderJSON(id))
+	case "authz", "chall":
+		aid := strings.SplitN(id, "/", 2)
+		a := f.authzs[aid[0]]
+		if a == nil || a.account != account {
+			f.problem(w, "unauthorized", "no such authorization")
+			return
+		}
+		if parts[0] == "chall" {
+			if f.stall {
+				f.reply(w, http.StatusOK, map[string]string{"status": "processing"})
+				return
+			}
+			if err := f.validate(a, aid[1]); err != nil {
+				a.status = "invalid"
+				a.err = map[string]string{"type": "urn:ietf:params:acme:error:incorrectResponse", "detail": err.Error()}
+			} else {
+				a.status = "valid"
+			}
+			f.reply(w, http.StatusOK, map[string]string{"status": "processing"})
+			return
+		}
+		var challenges []map[string]interface{}
+		for _, typ := range []string{ACMEChallengeHTTP01, ACMEChallengeTLSALPN01} {
+			challenges = append(challenges, map[string]interface{}{"type": typ, "url": f.srv.URL + "/chall/" + aid[0] + "/" + typ, "token": a.token, "status": a.status, "error": a.err})
+		}
+		f.reply(w, http.StatusOK, map[string]interface{}{
+			"status":     a.status,
+			"identifier": map[string]string{"type": "dns", "value": a.domain},
+			"challenges": challenges,
+		})
+	case "finalize":
+		o := f.orders[id]
+		for _, aid := range o.authzs {
+			if f.authzs[aid].status != "valid" {
+				f.problem(w, "orderNotReady", "authorizations pending")
+				return
+			}
+		}
+		var finalize struct{ CSR string }
+		json.Unmarshal(payload, &finalize)
+		der, _ := base64.RawURLEncoding.DecodeString(finalize.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || csr.CheckSignature() != nil || strings.Join(csr.DNSNames, ",") != strings.Join(o.domains, ",") {
+			f.problem(w, "badCSR", fmt.Sprintf("%v", err))
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		leaf, err := x509.CreateCertificate(rand.Reader, tmpl, f.ca.Leaf, csr.PublicKey, f.ca.PrivateKey)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		o.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.ca.Certificate[0]})...)
+		o.status = "processing" //makes the client poll
+		f.reply(w, http.StatusOK, f.orderJSON(id))
+		o.status = "valid"
+	case "orders":
+		f.reply(w, http.StatusOK, f.orderJSON(id))
+	case "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(f.orders[id].chain)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestACMEManager(t *testing.T) {
+	for _, challenge := range []string{ACMEChallengeHTTP01, ACMEChallengeTLSALPN01} {
+		t.Run(challenge, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "jumphasher")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			ca := newFakeACME(t)
+			defer ca.srv.Close()
+			ca.badNonces = 1
+			acme := &ACMEConfig{
+				Directory: ca.srv.URL + "/dir",
+				Domains:   []string{"example.test", "www.example.test"},
+				CacheDir:  dir,
+				Challenge: challenge,
+				AcceptTOS: true,
+			}
+			sslcfg := &SSLConfig{ACME: acme, Exclusive: challenge == ACMEChallengeTLSALPN01}
+			e := newTestEngine(t, EngineConfig{SSL: sslcfg})
+			e.alive.TestAndSet()
+			e.startWorkers()
+			if e.httpSrv != nil {
+				plain := httptest.NewServer(e.httpSrv.Handler)
+				defer plain.Close()
+				ca.httpAddr = plain.Listener.Addr().String()
+				if resp, err := http.Get(plain.URL + acmeChallengePath + "unknown"); err != nil || resp.StatusCode != http.StatusNotFound {
+					t.Errorf("Expected 404 for unknown challenge token, got %v %v", resp, err)
+				}
+			}
+			srv := httptest.NewUnstartedServer(e.Handler())
+			srv.TLS = e.httpsSrv.TLSConfig
+			srv.StartTLS()
+			defer srv.Close()
+			ca.tlsAddr = srv.Listener.Addr().String()
+
+			if _, err := e.acme.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.test"}); err != ErrNoACMECertificate {
+				t.Errorf("Expected ErrNoACMECertificate before issuance, got %v", err)
+			}
+			if err := e.acme.obtain(); err != nil {
+				t.Fatal(err)
+			}
+
+			//the issued certificate is served for both names
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.ca.Leaf)
+			for _, name := range acme.Domains {
+				client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: name}}}
+				resp, err := client.Get(srv.URL + "/hash?id=00000000000000000000000000000000")
+				if err != nil {
+					t.Fatalf("%s: %s", name, err)
+				}
+				resp.Body.Close()
+			}
+			m := e.certMetrics()["https"]
+			if m.Reloads != 1 || m.ExpiresIn < int64((89*24*time.Hour).Seconds()) || m.LastError != "" {
+				t.Errorf("Unexpected metrics: %+v", m)
+			}
+			if e.acme.due() {
+				t.Error("Fresh certificate is due for renewal")
+			}
+			srv.Close()
+			e.Stop()
+
+			//a restart serves the cached certificate without contacting the CA, and renewals reuse the account
+			served, _ := e.acme.GetCertificate(&tls.ClientHelloInfo{})
+			restarted, err := NewACMEManager(*acme)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer restarted.Close()
+			cached, err := restarted.GetCertificate(&tls.ClientHelloInfo{})
+			if err != nil || !bytes.Equal(cached.Certificate[0], served.Certificate[0]) {
+				t.Errorf("Cached certificate not loaded: %v", err)
+			}
+			ca.lock.Lock()
+			orders, accounts := len(ca.orders), len(ca.accounts)
+			ca.lock.Unlock()
+			if orders != 1 || accounts != 1 {
+				t.Errorf("Expected 1 order and 1 account. Actual: %d orders and %d accounts", orders, accounts)
+			}
+		})
+	}
+
+	//http-01 needs the plain HTTP listener
+	cfg := &ACMEConfig{Directory: "http://127.0.0.1/dir", Domains: []string{"example.test"}, CacheDir: os.TempDir(), Challenge: ACMEChallengeHTTP01, AcceptTOS: true}
+	if _, err := NewAPIEngine(EngineConfig{Concurrency: 1, SSL: &SSLConfig{ACME: cfg, Exclusive: true}}); err == nil {
+		t.Error("Expected error for http-01 with sslmode=exclusive")
+	}
+
+	//the operator has to accept the CA's terms themselves
+	cfg.AcceptTOS = false
+	if _, err := NewACMEManager(*cfg); err != ErrACMETermsNotAccepted {
+		t.Errorf("Expected: %v Actual: %v", ErrACMETermsNotAccepted, err)
+	}
+}
+
+//Close doesn't wait out a CA that's slow to validate
+func TestACMEManager_Close(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jumphasher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newFakeACME(t)
+	defer ca.srv.Close()
+	ca.stall = true
+	m, err := NewACMEManager(ACMEConfig{Directory: ca.srv.URL + "/dir", Domains: []string{"example.test"}, CacheDir: dir, Challenge: ACMEChallengeHTTP01, AcceptTOS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.cfg.Client.Timeout != acmeRequestTimeout {
+		t.Errorf("Expected default client timeout: %s Actual: %s", acmeRequestTimeout, m.cfg.Client.Timeout)
+	}
+	m.Start()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		m.lock.Lock()
+		polling := len(m.tokens) == 1
+		m.lock.Unlock()
+		if polling {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Never started polling the CA")
+		}
+	}
+	start := time.Now()
+	m.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close took %s", elapsed)
+	}
+	if m.Metrics().LastError != "" {
+		t.Errorf("Abandoned attempt recorded as a failure: %s", m.Metrics().LastError)
+	}
+}
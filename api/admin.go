@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/iamthebot/jumphasher/common"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//Settings for the admin listener
+//
+//At least one of Token and ClientCAFile must be set. When both are, requests must pass both checks
+type AdminConfig struct {
+	Addr         string //address to listen on, eg; 127.0.0.1:8081
+	Token        []byte //if not empty, requests must send 'Authorization: Bearer <Token>'
+	ClientCAFile string //if not empty, clients must present a certificate signed by a CA in this PEM file
+	CertFile     string //certificate served by the admin listener. If empty, the admin listener uses plain HTTP
+	KeyFile      string //private key for CertFile
+}
+
+var ErrAdminUnauthenticated error = errors.New("admin listener needs a bearer token, a client CA, or both")
+
+//Bucket count and migration state of the hash store, and optionally its size and whether it holds a job
+//
+//This is what we return from POST /admin/store
+type StoreStatus struct {
+	Buckets  int   `json:"buckets"`
+	Resizing bool  `json:"resizing"`
+	Entries  *int  `json:"entries,omitempty"` //only with count=true
+	Found    *bool `json:"found,omitempty"`   //only with id
+}
+
+//Sets up the admin listener from cfg
+func (e *APIEngine) initAdmin(cfg *AdminConfig) error {
+	if len(cfg.Token) == 0 && cfg.ClientCAFile == "" {
+		return ErrAdminUnauthenticated
+	}
+	e.admin = cfg
+	e.adminMux = http.NewServeMux()
+	e.adminMux.HandleFunc("/admin/shutdown", e.onAdminShutdownPost)
+	e.adminMux.HandleFunc("/admin/stats", e.onAdminStatsPost)
+	e.adminMux.HandleFunc("/admin/stats/reset", e.onAdminStatsResetPost)
+	e.adminMux.HandleFunc("/admin/store", e.onAdminStorePost)
+	e.adminMux.HandleFunc("/admin/reshard", e.onAdminReshardPost)
+	e.adminMux.HandleFunc("/admin/loglevel", e.onAdminLogLevelPost)
+	e.adminMux.HandleFunc("/admin/ratelimits", e.onAdminRateLimitsPost)
+	e.adminMux.HandleFunc("/admin/webhooks/deadletters", e.onAdminDeadLettersPost)
+	e.adminSrv = &http.Server{Addr: cfg.Addr, Handler: e.audited(e.requireAdmin(e.adminMux))}
+	if cfg.ClientCAFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return errors.New("client certificate authentication needs the admin listener to serve TLS")
+		}
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		e.adminSrv.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+	if cfg.CertFile != "" {
+		certs, err := NewCertReloader(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		e.adminCerts = certs
+		e.adminSrv.TLSConfig = certTLSConfig(certs, e.adminSrv.TLSConfig)
+	}
+	return nil
+}
+
+//Starts the admin listener, sending its exit error to errs
+func (e *APIEngine) serveAdmin(errs chan<- error) {
+	if e.admin.CertFile != "" {
+		infof("Admin server now accepting https connections at %s", e.admin.Addr)
+		errs <- e.adminSrv.ListenAndServeTLS("", "")
+	} else {
+		infof("Admin server now accepting http connections at %s", e.admin.Addr)
+		errs <- e.adminSrv.ListenAndServe()
+	}
+}
+
+//Wraps the admin muxer with authentication. Client certificates, if required, were already verified during the handshake
+//
+//Every admin operation changes or exposes server state, so only POST is accepted
+func (e *APIEngine) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(e.admin.Token) > 0 {
+			auth := req.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), e.admin.Token) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="jumphasher admin"`)
+				http.Error(w, "missing or invalid admin token", http.StatusUnauthorized)
+				return
+			}
+		}
+		if a := requestAuthOf(req); a != nil {
+			if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+				a.Method, a.Identity = AuthMethodCert, certIdentity(req.TLS.VerifiedChains[0][0], ClientIdentitySubject)
+			} else {
+				a.Method = AuthMethodToken
+			}
+		}
+		if req.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, fmt.Sprintf("Unsupported method: %s", req.Method), 405)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func writeAdminText(w http.ResponseWriter, status int, r string) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(r)))
+	w.WriteHeader(status)
+	io.WriteString(w, r)
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(j)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+}
+
+//route handler for POST /admin/shutdown
+func (e *APIEngine) onAdminShutdownPost(w http.ResponseWriter, req *http.Request) {
+	if !e.alive.Test() {
+		http.Error(w, "server already shutting down", http.StatusConflict)
+		return
+	}
+	writeAdminText(w, http.StatusOK, "commencing shutdown")
+	infof("Received shutdown request. Commencing shutdown")
+	go e.Stop()
+}
+
+//route handler for POST /admin/stats
+//
+//As GET /stats, but with every tenant's rate limiter state
+func (e *APIEngine) onAdminStatsPost(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, e.stats())
+}
+
+//route handler for POST /admin/stats/reset
+//
+//Zeroes request and shed counters, responding with the stats as they were just before the reset.
+//Gauges such as the backlog and queue depths, rate limit buckets and quota usage aren't affected
+func (e *APIEngine) onAdminStatsResetPost(w http.ResponseWriter, req *http.Request) {
+	snap := e.stats()
+	e.metrics.Reset()
+	atomic.StoreInt64(&e.shed, 0)
+	atomic.StoreInt64(&e.pool.scaleEvents, 0)
+	e.limiter.ResetCounters()
+	for p := range e.classes {
+		atomic.StoreInt64(&e.classes[p].served, 0)
+		atomic.StoreInt64(&e.classes[p].shed, 0)
+		atomic.StoreInt64(&e.classes[p].waitNanos, 0)
+	}
+	infof("Stats reset via admin API")
+	writeAdminJSON(w, snap)
+}
+
+//route handler for POST /admin/store
+//
+//Reports the hash store's bucket count and migration state. With count=true, also counts every entry, which walks
+//the whole store. With id, also reports whether a hash is stored for that job, as seen by the tenant named by the
+//'tenant' parameter if given. The hash itself is never returned
+func (e *APIEngine) onAdminStorePost(w http.ResponseWriter, req *http.Request) {
+	var status StoreStatus
+	if rs, ok := resizableStore(e.store); ok {
+		status.Buckets = rs.Size()
+		status.Resizing = rs.Resizing()
+	}
+	q := req.URL.Query()
+	if q.Get("count") == "true" {
+		n := 0
+		err := e.store.Range(func(id *jumphasher.UUID, h []byte) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status.Entries = &n
+	}
+	if strid := q.Get("id"); strid != "" {
+		var u jumphasher.UUID
+		if err := u.UnmarshalText(strid); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if name := q.Get("tenant"); name != "" {
+			u = NewTenant(name, PriorityNormal, e.tenantSecret).JobKey(&u)
+		}
+		h, err := e.store.Load(&u)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		found := h != nil
+		status.Found = &found
+	}
+	writeAdminJSON(w, &status)
+}
+
+//route handler for POST /admin/reshard
+//
+//Starts migrating the hash store to the number of buckets given by the 'buckets' parameter.
+//Migration runs in the background; poll POST /admin/store for progress
+func (e *APIEngine) onAdminReshardPost(w http.ResponseWriter, req *http.Request) {
+	rs, ok := resizableStore(e.store)
+	if !ok {
+		http.Error(w, "hash store does not support resharding", http.StatusNotImplemented)
+		return
+	}
+	n, err := strconv.Atoi(req.URL.Query().Get("buckets"))
+	if err != nil || n < 1 || n > jumphasher.MaxStoreSize {
+		http.Error(w, fmt.Sprintf("must provide a bucket count from 1 to %d via the 'buckets' parameter", jumphasher.MaxStoreSize), http.StatusBadRequest)
+		return
+	}
+	if rs.Resizing() {
+		http.Error(w, jumphasher.ErrResizeInProgress.Error(), http.StatusConflict)
+		return
+	}
+	go func() {
+		start := time.Now()
+		infof("Resharding hash store from %d to %d buckets", rs.Size(), n)
+		if err := rs.Resize(n); err != nil {
+			log.Printf("Error: could not reshard hash store: %s", err.Error())
+			return
+		}
+		infof("Resharded hash store to %d buckets in %s", n, time.Since(start))
+	}()
+	writeAdminText(w, http.StatusAccepted, fmt.Sprintf("resharding to %d buckets", n))
+}
+
+//route handler for POST /admin/loglevel
+//
+//Sets the log level to the 'level' parameter if given, responding with the level now in effect
+func (e *APIEngine) onAdminLogLevelPost(w http.ResponseWriter, req *http.Request) {
+	if level := req.URL.Query().Get("level"); level != "" {
+		if err := SetLogLevel(level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Log level set to %s via admin API", level)
+	}
+	writeAdminText(w, http.StatusOK, LogLevel())
+}
+
+//route handler for POST /admin/ratelimits
+//
+//Changes whichever of 'key_rate', 'key_burst', 'ip_rate', 'ip_burst' and 'daily_quota' are given, responding with
+//the limits now in effect. With 'tenant', 'daily_quota' overrides the quota for that tenant only, and
+//daily_quota=default removes the override
+func (e *APIEngine) onAdminRateLimitsPost(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	limits := e.limiter.Limits()
+	var err error
+	for _, f := range []struct {
+		name string
+		rate *float64
+	}{{"key_rate", &limits.KeyRate}, {"ip_rate", &limits.IPRate}} {
+		if v := q.Get(f.name); v != "" {
+			if *f.rate, err = strconv.ParseFloat(v, 64); err != nil || *f.rate < 0 {
+				http.Error(w, fmt.Sprintf("'%s' must be a non-negative number of requests per second", f.name), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	for _, f := range []struct {
+		name  string
+		burst *int
+	}{{"key_burst", &limits.KeyBurst}, {"ip_burst", &limits.IPBurst}} {
+		if v := q.Get(f.name); v != "" {
+			if *f.burst, err = strconv.Atoi(v); err != nil || *f.burst < 0 {
+				http.Error(w, fmt.Sprintf("'%s' must be a non-negative number of requests", f.name), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	tenant := q.Get("tenant")
+	if v := q.Get("daily_quota"); v == "default" && tenant != "" {
+		delete(limits.TenantQuotas, tenant)
+	} else if v != "" {
+		quota, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || quota < 0 {
+			http.Error(w, "'daily_quota' must be a non-negative number of requests", http.StatusBadRequest)
+			return
+		}
+		if tenant != "" {
+			limits.TenantQuotas[tenant] = quota
+		} else {
+			limits.DailyQuota = quota
+		}
+	}
+	e.limiter.SetLimits(limits)
+	infof("Rate limits set via admin API: %+v", limits)
+	writeAdminJSON(w, &limits)
+}
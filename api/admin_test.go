@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"github.com/iamthebot/jumphasher/common"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newAdminRequest(method, target, token string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func TestAPIEngine_requireAdmin(t *testing.T) {
+	if _, err := NewAPIEngine(EngineConfig{Concurrency: 1, Admin: &AdminConfig{Addr: ":0"}}); err != ErrAdminUnauthenticated {
+		t.Errorf("Expected: %v Actual: %v", ErrAdminUnauthenticated, err)
+	}
+	e := newTestEngine(t, EngineConfig{Admin: &AdminConfig{Addr: ":0", Token: []byte("s3cret")}})
+	h := e.adminSrv.Handler
+	for _, c := range []struct {
+		method, token string
+		code          int
+	}{
+		{"POST", "", http.StatusUnauthorized},
+		{"POST", "guess", http.StatusUnauthorized},
+		{"GET", "s3cret", http.StatusMethodNotAllowed},
+		{"POST", "s3cret", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newAdminRequest(c.method, "/admin/loglevel", c.token))
+		if w.Code != c.code {
+			t.Errorf("%s with token %q: Expected status: %d Actual: %d", c.method, c.token, c.code, w.Code)
+		}
+	}
+
+	//admin operations are gone from the public API
+	w := httptest.NewRecorder()
+	e.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/shutdown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestAPIEngine_adminOperations(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{Admin: &AdminConfig{Addr: ":0", Token: []byte("s3cret")}})
+	e.alive.TestAndSet()
+	e.startWorkers()
+	h := e.adminSrv.Handler
+	u, _ := jumphasher.UUIDv4()
+	e.store.Store(u, []byte("hash"))
+	e.metrics.AddDuration(1000000)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newAdminRequest("POST", "/admin/store?count=true&id="+u.MarshalText(), "s3cret"))
+	var status StoreStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Buckets != 2 || status.Entries == nil || *status.Entries != 1 || status.Found == nil || !*status.Found {
+		t.Errorf("Unexpected store status: %s", w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "hash") {
+		t.Error("Store inspection leaked a hash")
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newAdminRequest("POST", "/admin/stats", "s3cret"))
+	var full MSMetrics
+	if err := json.Unmarshal(w.Body.Bytes(), &full); err != nil {
+		t.Fatal(err)
+	}
+	if full.Total != 1 || full.Limiter == nil {
+		t.Errorf("Unexpected stats: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newAdminRequest("POST", "/admin/stats/reset", "s3cret"))
+	var snap MSMetrics
+	if err := json.Unmarshal(w.Body.Bytes(), &snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.Total != 1 || e.stats().Total != 0 {
+		t.Errorf("Expected total before reset: 1 after: 0 Actual: %d %d", snap.Total, e.stats().Total)
+	}
+
+	defer SetLogLevel("info")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newAdminRequest("POST", "/admin/loglevel?level=debug", "s3cret"))
+	if w.Body.String() != "debug" || LogLevel() != "debug" {
+		t.Errorf("Expected log level: debug Actual: %s", LogLevel())
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newAdminRequest("POST", "/admin/loglevel?level=verbose", "s3cret"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newAdminRequest("POST", "/admin/reshard?buckets=1000000000000", "s3cret"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusBadRequest, w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newAdminRequest("POST", "/admin/reshard?buckets=4", "s3cret"))
+	if w.Code != http.StatusAccepted {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusAccepted, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newAdminRequest("POST", "/admin/shutdown", "s3cret"))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusOK, w.Code)
+	}
+	e.Stop()
+}
+
+//With a client CA, the admin listener refuses clients without a certificate signed by it
+func TestAPIEngine_adminClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jumphasher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := filepath.Join(dir, "admin.crt"), filepath.Join(dir, "admin.pem")
+	if err := GenSelfSignedCert(key, cert); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewAPIEngine(EngineConfig{Concurrency: 1, Admin: &AdminConfig{Addr: ":0", ClientCAFile: cert}}); err == nil {
+		t.Error("Expected error for client CA without a server certificate")
+	}
+	e := newTestEngine(t, EngineConfig{Admin: &AdminConfig{Addr: ":0", ClientCAFile: cert, CertFile: cert, KeyFile: key}})
+	srv := httptest.NewUnstartedServer(e.adminSrv.Handler)
+	srv.TLS = e.adminSrv.TLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	clientCert, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, certs := range [][]tls.Certificate{nil, {clientCert}} {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: certs}}}
+		resp, err := client.Post(srv.URL+"/admin/loglevel", "text/plain", nil)
+		if certs == nil {
+			if err == nil {
+				resp.Body.Close()
+				t.Error("Admin request without a client certificate succeeded")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status: %d Actual: %d", http.StatusOK, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Ways a request can be authenticated, as recorded in the audit log
+const (
+	AuthMethodNone  = "none"  //open API, or the request was refused
+	AuthMethodKey   = "key"   //API key
+	AuthMethodCert  = "cert"  //verified client certificate
+	AuthMethodToken = "token" //admin bearer token
+)
+
+//Who a request was authenticated as
+type requestAuth struct {
+	Method   string
+	Identity string  //client certificate identity, or 'key:' followed by the API key's ID
+	Tenant   *Tenant //nil for the default tenant
+}
+
+type authContextKey struct{}
+
+//Authentication state of a request, or nil if it wasn't authenticated or audited
+func requestAuthOf(req *http.Request) *requestAuth {
+	a, _ := req.Context().Value(authContextKey{}).(*requestAuth)
+	return a
+}
+
+//Attaches a new authentication state to req, unless the audit layer already did
+func withRequestAuth(req *http.Request) (*http.Request, *requestAuth) {
+	if a := requestAuthOf(req); a != nil {
+		return req, a
+	}
+	a := &requestAuth{Method: AuthMethodNone}
+	return req.WithContext(context.WithValue(req.Context(), authContextKey{}, a)), a
+}
+
+//Tenant the request was authenticated as, or nil for the default tenant
+func requestTenant(req *http.Request) *Tenant {
+	if a := requestAuthOf(req); a != nil {
+		return a.Tenant
+	}
+	return nil
+}
+
+//Wraps the public API with authentication, attaching the caller's tenant to the request context
+//
+//A verified client certificate identifies the tenant by its identity. With API keys enabled, that identity must
+//name a tenant in the keys file, and requests without a certificate must carry a key. A request carrying both must
+//have them agree on the tenant
+func (e *APIEngine) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req, a := withRequestAuth(req)
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+			identity := certIdentity(req.TLS.VerifiedChains[0][0], e.sslcfg.ClientIdentity)
+			if identity == "" {
+				http.Error(w, fmt.Sprintf("client certificate has no %s identity", e.sslcfg.ClientIdentity), http.StatusForbidden)
+				return
+			}
+			a.Method, a.Identity = AuthMethodCert, identity
+			t := NewTenant(identity, PriorityNormal, e.tenantSecret)
+			if e.keys != nil {
+				known := e.keys.Tenant(identity)
+				if known == nil {
+					http.Error(w, fmt.Sprintf("client certificate identity %s is not a known tenant", identity), http.StatusForbidden)
+					return
+				}
+				*t = *known
+			}
+			t.keyID = "cert:" + identity //rate limited like an API key of its own
+			a.Tenant = t
+		}
+		if e.keys != nil {
+			key := req.Header.Get(APIKeyHeader)
+			if auth := req.Header.Get("Authorization"); key == "" && strings.HasPrefix(auth, "Bearer ") {
+				key = auth[len("Bearer "):]
+			}
+			if key != "" || a.Tenant == nil {
+				t := e.keys.Lookup(key)
+				if t == nil {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="jumphasher"`)
+					http.Error(w, "missing or invalid API key", http.StatusUnauthorized)
+					return
+				}
+				if a.Tenant != nil && a.Tenant.Name != t.Name {
+					http.Error(w, "API key and client certificate belong to different tenants", http.StatusForbidden)
+					return
+				}
+				if a.Tenant == nil {
+					a.Method, a.Identity = AuthMethodKey, "key:"+t.keyID
+				}
+				a.Tenant = t
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+//A single request in the audit log
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Remote   string    `json:"remote"`
+	Auth     string    `json:"auth"` //'none', 'key', 'cert' or 'token'
+	Identity string    `json:"identity,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	Duration float64   `json:"duration_ms"`
+}
+
+//Append-only log of every request to the API and admin listeners, one JSON AuditRecord per line
+type AuditLog struct {
+	f    *os.File
+	lock sync.Mutex
+}
+
+//Opens (or creates) the audit log at path
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{f: f}, nil
+}
+
+func (l *AuditLog) Record(rec *AuditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Error: could not encode audit record: %s", err.Error())
+		return
+	}
+	line = append(line, '\n')
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := l.f.Write(line); err != nil {
+		log.Printf("Error: could not write audit record: %s", err.Error())
+	}
+}
+
+func (l *AuditLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.f.Close()
+}
+
+//Remembers the status a handler responded with
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+//Event streams and batches flush as they go
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//Wraps a listener's handler so every request is recorded in the audit log once it completes. If auditing is
+//disabled, next is returned as is
+func (e *APIEngine) audited(next http.Handler) http.Handler {
+	if e.audit == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		req, a := withRequestAuth(req)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, req)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		e.audit.Record(&AuditRecord{
+			Time:     start.UTC(),
+			Remote:   clientIP(req),
+			Auth:     a.Method,
+			Identity: a.Identity,
+			Tenant:   tenantName(a.Tenant),
+			Method:   req.Method,
+			Path:     req.URL.Path,
+			Status:   sw.status,
+			Duration: float64(time.Since(start)) / float64(time.Millisecond),
+		})
+	})
+}
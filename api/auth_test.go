@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Issues a client certificate for cn signed by ca. With a nil ca, returns a self-signed CA instead
+func issueTestCert(t *testing.T, cn string, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, interface{}(key)
+	if ca == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestAPIEngine_clientCertAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jumphasher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := issueTestCert(t, "test CA", nil)
+	caPath := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0600)
+	keysPath := filepath.Join(dir, "apikeys")
+	writeAPIKeys(t, keysPath, testKeyA+":team-a", testKeyB+":team-b")
+	keys, err := LoadAPIKeys(keysPath, testTenantSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditPath := filepath.Join(dir, "audit.log")
+	sslcfg := &SSLConfig{CertFile: filepath.Join(dir, "server.crt"), KeyFile: filepath.Join(dir, "server.pem"), ClientCAFile: caPath}
+	if err := GenSelfSignedCert(sslcfg.KeyFile, sslcfg.CertFile); err != nil {
+		t.Fatal(err)
+	}
+
+	required := *sslcfg
+	required.RequireClientCert = true
+	if _, err := NewAPIEngine(EngineConfig{Concurrency: 1, SSL: &required, TenantSecret: testTenantSecret}); err == nil {
+		t.Error("Expected error for required client certificates alongside plain HTTP")
+	}
+	sslcfg.Exclusive = true
+	e := newTestEngine(t, EngineConfig{SSL: sslcfg, APIKeys: keys, TenantSecret: testTenantSecret, AuditLogPath: auditPath})
+	e.alive.TestAndSet()
+	e.startWorkers()
+	srv := httptest.NewUnstartedServer(e.Handler())
+	srv.TLS = e.httpsSrv.TLSConfig
+	srv.StartTLS()
+
+	do := func(cert *tls.Certificate, key, method, target string) (int, string) {
+		tlsCfg := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			tlsCfg.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+		req, _ := http.NewRequest(method, srv.URL+target, strings.NewReader("hunter2"))
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	teamA := issueTestCert(t, "team-a", &ca)
+	stranger := issueTestCert(t, "team-c", &ca)
+
+	//the certificate's tenant shares a namespace with API keys for the same tenant
+	code, id := do(&teamA, "", "POST", "/hash?delay=0")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status: %d Actual: %d (%s)", http.StatusOK, code, id)
+	}
+	if code, _ := do(nil, testKeyA, "GET", "/hash?id="+id); code != http.StatusOK {
+		t.Errorf("Same tenant by API key: Expected status: %d Actual: %d", http.StatusOK, code)
+	}
+	for _, c := range []struct {
+		cert *tls.Certificate
+		key  string
+		code int
+	}{
+		{&stranger, "", http.StatusForbidden},
+		{&teamA, testKeyB, http.StatusForbidden},
+		{&teamA, testKeyA, http.StatusNotFound},
+		{nil, "", http.StatusUnauthorized},
+	} {
+		if code, body := do(c.cert, c.key, "GET", "/hash?id=00000000000000000000000000000000"); code != c.code {
+			t.Errorf("Expected status: %d Actual: %d (%s)", c.code, code, body)
+		}
+	}
+	srv.Close()
+	e.Stop()
+
+	f, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []AuditRecord
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 6 {
+		t.Fatalf("Expected audit records: %d Actual: %d", 6, len(records))
+	}
+	if r := records[0]; r.Auth != AuthMethodCert || r.Identity != "team-a" || r.Tenant != "team-a" || r.Method != "POST" || r.Path != "/hash" || r.Status != http.StatusOK {
+		t.Errorf("Unexpected audit record: %+v", r)
+	}
+	if r := records[1]; r.Auth != AuthMethodKey || !strings.HasPrefix(r.Identity, "key:") || r.Tenant != "team-a" {
+		t.Errorf("Unexpected audit record: %+v", r)
+	}
+	if r := records[5]; r.Auth != AuthMethodNone || r.Status != http.StatusUnauthorized {
+		t.Errorf("Unexpected audit record: %+v", r)
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	cert := issueTestCert(t, "payments", nil).Leaf
+	cert.DNSNames = []string{"payments.internal"}
+	if id := certIdentity(cert, ClientIdentitySubject); id != "payments" {
+		t.Errorf("Expected identity: %s Actual: %s", "payments", id)
+	}
+	if id := certIdentity(cert, ClientIdentitySAN); id != "payments.internal" {
+		t.Errorf("Expected identity: %s Actual: %s", "payments.internal", id)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/iamthebot/jumphasher/common"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Default cap on the number of passwords in a single POST /hash/batch
+const DefaultMaxBatch = 10000
+
+//Results are flushed to the client at least this often
+const batchFlushEvery = 64
+
+//Outcome of a single password in a batch
+type BatchResult struct {
+	Index int    `json:"index"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+//A batch item in flight
+type batchSlot struct {
+	r      HashingRequest
+	result BatchResult
+	done   chan struct{}
+}
+
+//route handler for POST /hash/batch
+//
+//Accepts either a JSON array of password strings or, with Content-Type application/x-ndjson,
+//one JSON string per line. Responds in the same shape with one result per password, in input order.
+//Passwords are fanned out to the workers as they're decoded and results are streamed back as soon as
+//every earlier result is ready, so arbitrarily large batches don't need to be buffered.
+//A password that can't be accepted gets an error in its result rather than failing the whole batch.
+//Each password counts against the rate limits separately
+func (e *APIEngine) onHashBatchPost(w http.ResponseWriter, req *http.Request) {
+	if !e.alive.Test() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer req.Body.Close()
+	tmpl, err := e.parseHashOptions(req, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip := clientIP(req)
+	ndjson := strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-ndjson")
+	dec := json.NewDecoder(bufio.NewReader(req.Body))
+	if !ndjson {
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			http.Error(w, "batch must be a JSON array of passwords, or NDJSON with Content-Type application/x-ndjson", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	//results are written in input order by a single writer
+	window := 4 * e.pool.max
+	order := make(chan *batchSlot, window)
+	writerDone := make(chan struct{})
+	go e.writeBatchResults(w, order, ndjson, writerDone)
+
+	//a fixed pool of submitters keeps up to window passwords in flight
+	work := make(chan *batchSlot)
+	var submitters sync.WaitGroup
+	for i := 0; i < window; i++ {
+		submitters.Add(1)
+		go func() {
+			defer submitters.Done()
+			for s := range work {
+				start := time.Now()
+				if err := e.submit(&s.r); err != nil {
+					s.result.Error = err.Error()
+				} else {
+					clientID := s.r.Tenant.ClientID(&s.r.ID)
+					s.result.ID = clientID.MarshalText()
+					e.metrics.AddDuration(time.Since(start).Nanoseconds())
+				}
+				close(s.done)
+			}
+		}()
+	}
+
+	//fail is used for problems with the batch itself, reported as a final result with no ID
+	fail := func(index int, msg string) {
+		s := &batchSlot{result: BatchResult{Index: index, Error: msg}, done: make(chan struct{})}
+		close(s.done)
+		order <- s
+	}
+	for i := 0; ; i++ {
+		if !ndjson && !dec.More() {
+			break
+		}
+		var password string
+		if err := dec.Decode(&password); err == io.EOF {
+			break
+		} else if err != nil {
+			fail(i, fmt.Sprintf("malformed batch item: %s", err.Error()))
+			break
+		}
+		if i >= e.maxBatch {
+			fail(i, fmt.Sprintf("batch exceeds maximum size of %d", e.maxBatch))
+			break
+		}
+		s := &batchSlot{r: *tmpl, done: make(chan struct{})}
+		s.result.Index = i
+		s.r.Password = []byte(password)
+		if d := e.limiter.Allow(ip, tmpl.Tenant); !d.Allowed {
+			s.result.Error = fmt.Sprintf("%s: %s limit", ErrRateLimited.Error(), d.Reason)
+			close(s.done)
+			order <- s
+			continue
+		}
+		id, err := jumphasher.UUIDv4()
+		if err != nil {
+			s.result.Error = err.Error()
+			close(s.done)
+			order <- s
+			continue
+		}
+		s.r.ID = s.r.Tenant.JobKey(id)
+		order <- s
+		work <- s
+	}
+	close(work)
+	submitters.Wait()
+	close(order)
+	<-writerDone
+}
+
+//Writes batch results in order as they complete, flushing periodically
+func (e *APIEngine) writeBatchResults(w http.ResponseWriter, order chan *batchSlot, ndjson bool, done chan struct{}) {
+	defer close(done)
+	flusher, _ := w.(http.Flusher)
+	bw := bufio.NewWriter(w)
+	if !ndjson {
+		bw.WriteString("[")
+	}
+	n := 0
+	for s := range order {
+		<-s.done
+		j, _ := json.Marshal(s.result)
+		if !ndjson && n > 0 {
+			bw.WriteString(",")
+		}
+		bw.Write(j)
+		if ndjson {
+			bw.WriteString("\n")
+		}
+		n++
+		//flush whenever we catch up with the workers, or every so often if we never do
+		if len(order) == 0 || n%batchFlushEvery == 0 {
+			bw.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if !ndjson {
+		bw.WriteString("]")
+	}
+	bw.Flush()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/iamthebot/jumphasher/common"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIEngine_onHashBatchPost(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{Delay: time.Minute})
+	e.alive.TestAndSet()
+	e.startWorkers()
+	passwords := []string{"hunter2", "jumpcloud", "", "correct horse battery staple"}
+	body, _ := json.Marshal(passwords)
+
+	w := httptest.NewRecorder()
+	e.onHashBatchPost(w, httptest.NewRequest("POST", "/hash/batch?delay=0", strings.NewReader(string(body))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status: %d Actual: %d (%s)", http.StatusOK, w.Code, w.Body.String())
+	}
+	var results []BatchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("Malformed response %q: %s", w.Body.String(), err.Error())
+	}
+	if len(results) != len(passwords) {
+		t.Fatalf("Expected results: %d Actual: %d", len(passwords), len(results))
+	}
+	engine := jumphasher.NewSHA512Engine()
+	for i, r := range results {
+		if r.Index != i || r.Error != "" {
+			t.Fatalf("Unexpected result %d: %+v", i, r)
+		}
+		var u jumphasher.UUID
+		if err := u.UnmarshalText(r.ID); err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := engine.Hash([]byte(passwords[i]))
+		if h, _ := e.store.Load(&u); string(h) != string(expected) {
+			t.Errorf("Result %d does not hold the hash of its password", i)
+		}
+	}
+	if snap := e.metrics.MSSnapshot(); snap.Total != uint64(len(passwords)) {
+		t.Errorf("Expected requests: %d Actual: %d", len(passwords), snap.Total)
+	}
+
+	//not an array
+	w = httptest.NewRecorder()
+	e.onHashBatchPost(w, httptest.NewRequest("POST", "/hash/batch", strings.NewReader(`"hunter2"`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestAPIEngine_onHashBatchPostNDJSON(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{Delay: time.Minute, MaxBatch: 3})
+	e.alive.TestAndSet()
+	e.startWorkers()
+
+	//one malformed item, then more items than we allow
+	req := httptest.NewRequest("POST", "/hash/batch", strings.NewReader("\"a\"\n42\n"))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	e.onHashBatchPost(w, req)
+	results := readBatchNDJSON(t, w.Body.String())
+	if len(results) != 2 || results[0].ID == "" || results[1].Error == "" || results[1].ID != "" {
+		t.Errorf("Unexpected results for malformed batch: %+v", results)
+	}
+
+	req = httptest.NewRequest("POST", "/hash/batch", strings.NewReader("\"a\"\n\"b\"\n\"c\"\n\"d\"\n\"e\"\n"))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	w = httptest.NewRecorder()
+	e.onHashBatchPost(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Expected Content-Type: application/x-ndjson Actual: %s", ct)
+	}
+	results = readBatchNDJSON(t, w.Body.String())
+	if len(results) != 4 {
+		t.Fatalf("Expected results: %d Actual: %d", 4, len(results))
+	}
+	for i, r := range results[:3] {
+		if r.Index != i || r.ID == "" {
+			t.Errorf("Unexpected result %d: %+v", i, r)
+		}
+	}
+	if results[3].Index != 3 || results[3].Error == "" {
+		t.Errorf("Oversized batch was not cut off: %+v", results[3])
+	}
+}
+
+func readBatchNDJSON(t *testing.T, body string) []BatchResult {
+	var results []BatchResult
+	s := bufio.NewScanner(strings.NewReader(body))
+	for s.Scan() {
+		var r BatchResult
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("Malformed result line %q: %s", s.Text(), err.Error())
+		}
+		results = append(results, r)
+	}
+	return results
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/iamthebot/jumphasher/common"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//Number of cancelled job IDs remembered so GET /hash can report them as cancelled rather than missing
+const cancelledJobsRemembered = 100000
+
+//Bounded set of recently cancelled job IDs. Once full, the oldest are forgotten first
+type cancelledJobs struct {
+	ids  map[jumphasher.UUID]struct{}
+	ring []jumphasher.UUID //insertion order, for eviction
+	next int               //next slot to overwrite in ring once it's full
+	lock sync.RWMutex
+}
+
+func newCancelledJobs(size int) *cancelledJobs {
+	var c cancelledJobs
+	c.ids = make(map[jumphasher.UUID]struct{})
+	c.ring = make([]jumphasher.UUID, 0, size)
+	return &c
+}
+
+func (c *cancelledJobs) Add(id *jumphasher.UUID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, exists := c.ids[*id]; exists {
+		return
+	}
+	if len(c.ring) < cap(c.ring) {
+		c.ring = append(c.ring, *id)
+	} else {
+		delete(c.ids, c.ring[c.next])
+		c.ring[c.next] = *id
+		c.next = (c.next + 1) % len(c.ring)
+	}
+	c.ids[*id] = struct{}{}
+}
+
+func (c *cancelledJobs) Has(id *jumphasher.UUID) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	_, exists := c.ids[*id]
+	return exists
+}
+
+//route handler for POST /jobs/{id}/cancel
+//
+//Jobs are only acknowledged once a worker has hashed them, so by the time a client has a job ID the job is either
+//waiting out its delay or already stored. A waiting job is pulled from the scheduler and journal so its hash is never
+//stored, and GET /hash reports it as cancelled from then on. Cancelling a cancelled job is a no-op
+func (e *APIEngine) onJobCancelPost(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/jobs/"), "/")
+	if len(parts) != 2 || parts[1] != "cancel" {
+		http.NotFound(w, req)
+		return
+	}
+	var clientID jumphasher.UUID
+	if err := clientID.UnmarshalText(parts[0]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t := requestTenant(req)
+	u := t.JobKey(&clientID)
+	if e.scheduler.Cancel(&u) {
+		e.cancelled.Add(&u)
+		if e.journal != nil {
+			if err := e.journal.Done(&u); err != nil {
+				log.Printf("Error: could not mark cancelled job %s done in journal: %s", parts[0], err.Error())
+			}
+		}
+		e.events.Publish(t, &u, JobStateCancelled)
+	} else if !e.cancelled.Has(&u) {
+		hash, err := e.store.Load(&u)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else if hash != nil {
+			http.Error(w, "job has already completed", http.StatusConflict)
+		} else {
+			http.Error(w, "job not found, or its hash is being stored", http.StatusNotFound)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(JobStateCancelled))
+}
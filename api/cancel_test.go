@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/iamthebot/jumphasher/common"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIEngine_onJobCancelPost(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{Delay: time.Minute})
+	e.alive.TestAndSet()
+	e.startWorkers()
+	sub, _ := e.events.Subscribe(0, false)
+	defer e.events.Unsubscribe(sub)
+
+	w := httptest.NewRecorder()
+	e.onHashPost(w, httptest.NewRequest("POST", "/hash", strings.NewReader("hunter2")))
+	strid := w.Body.String()
+	<-sub.c //accepted
+
+	w = httptest.NewRecorder()
+	e.onJobCancelPost(w, httptest.NewRequest("POST", "/jobs/"+strid+"/cancel", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status: %d Actual: %d (%s)", http.StatusOK, w.Code, w.Body.String())
+	}
+	if e.scheduler.Len() != 0 {
+		t.Error("Cancelled job is still scheduled")
+	}
+	if ev := <-sub.c; ev.StrID != strid || ev.State != JobStateCancelled {
+		t.Errorf("Unexpected event: %+v", ev)
+	}
+	//cancelling again is harmless
+	w = httptest.NewRecorder()
+	e.onJobCancelPost(w, httptest.NewRequest("POST", "/jobs/"+strid+"/cancel", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusOK, w.Code)
+	}
+	w = httptest.NewRecorder()
+	e.onHashGet(w, httptest.NewRequest("GET", "/hash?id="+strid+"&wait=10s", nil))
+	if w.Code != http.StatusGone {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusGone, w.Code)
+	}
+
+	//too late once the hash is stored
+	w = httptest.NewRecorder()
+	e.onHashPost(w, httptest.NewRequest("POST", "/hash?delay=0", strings.NewReader("hunter2")))
+	w2 := httptest.NewRecorder()
+	e.onJobCancelPost(w2, httptest.NewRequest("POST", "/jobs/"+w.Body.String()+"/cancel", nil))
+	if w2.Code != http.StatusConflict {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusConflict, w2.Code)
+	}
+
+	for path, code := range map[string]int{
+		"/jobs/fcdff9fc6ec44f059164ec51a756524b/cancel": http.StatusNotFound,
+		"/jobs/nonsense/cancel":                         http.StatusBadRequest,
+		"/jobs/" + strid + "/frobnicate":                http.StatusNotFound,
+	} {
+		w = httptest.NewRecorder()
+		e.onJobCancelPost(w, httptest.NewRequest("POST", path, nil))
+		if w.Code != code {
+			t.Errorf("%s: Expected status: %d Actual: %d", path, code, w.Code)
+		}
+	}
+}
+
+func TestCancelledJobs_Eviction(t *testing.T) {
+	c := newCancelledJobs(2)
+	ids := make([]jumphasher.UUID, 3)
+	for i := range ids {
+		u, _ := jumphasher.UUIDv4()
+		ids[i] = *u
+		c.Add(u)
+	}
+	if c.Has(&ids[0]) || !c.Has(&ids[1]) || !c.Has(&ids[2]) {
+		t.Error("Expected only the oldest cancelled job to be forgotten")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//How often certificate and key files are checked for changes
+const certReloadInterval = 5 * time.Second
+
+//Where a TLS listener gets its certificate from on each handshake
+type certSource interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	Reload() error         //re-reads or re-checks the certificate, eg; on SIGHUP
+	Metrics() *CertMetrics //snapshot for GET /stats
+	Close()                //stops any background work
+}
+
+//Serves a certificate/key pair, reloading it whenever either file changes
+//
+//ListenAndServeTLS reads the pair once, so rotating a certificate used to mean a restart. Listeners instead get
+//their certificate from GetCertificate on every handshake. A new pair is only swapped in once it has loaded,
+//its key matches and it hasn't expired. Otherwise the previous pair keeps being served
+type CertReloader struct {
+	reloads  uint64       //successful reloads since startup. Accessed atomically, so kept first for alignment
+	cert     atomic.Value //*tls.Certificate with Leaf set
+	certFile string
+	keyFile  string
+	lastErr  atomic.Value //string. Why the most recent reload failed, or empty
+	certMod  time.Time    //modification times of the files last loaded, or tried. Guarded by lock
+	keyMod   time.Time
+	lock     sync.Mutex //serializes reloads from the watcher and SIGHUP
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+//Loads the pair in certFile and keyFile and starts watching them for changes
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	var r CertReloader
+	r.certFile = certFile
+	r.keyFile = keyFile
+	r.lastErr.Store("")
+	r.stop = make(chan struct{})
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	r.wg.Add(1)
+	go r.watch(certReloadInterval)
+	return &r, nil
+}
+
+//Loads the pair and checks that it's fit to serve
+func loadKeyPair(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate %s expired at %s", certFile, leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+//Reloads the pair unconditionally, keeping the current one if the new one is unusable
+//
+//The files' modification times are recorded either way, so the watcher doesn't retry a bad pair until it changes again
+func (r *CertReloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.certMod, r.keyMod = fileModTime(r.certFile), fileModTime(r.keyFile)
+	cert, err := loadKeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		r.lastErr.Store(err.Error())
+		return err
+	}
+	r.cert.Store(cert)
+	r.lastErr.Store("")
+	atomic.AddUint64(&r.reloads, 1)
+	return nil
+}
+
+func fileModTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+//Whether either file has been modified since it was last loaded or tried
+func (r *CertReloader) changed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return !fileModTime(r.certFile).Equal(r.certMod) || !fileModTime(r.keyFile).Equal(r.keyMod)
+}
+
+//Reloads the pair whenever either file's modification time changes
+//
+//Files are often replaced one at a time, so a half-rotated pair fails to load and is retried on the next change
+func (r *CertReloader) watch(interval time.Duration) {
+	defer r.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				log.Printf("Error: could not reload certificate %s, still serving the previous one: %s", r.certFile, err.Error())
+			} else {
+				infof("Reloaded certificate %s, valid until %s", r.certFile, r.NotAfter().UTC().Format(time.RFC3339))
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+//Stops watching the files
+func (r *CertReloader) Close() {
+	close(r.stop)
+	r.wg.Wait()
+}
+
+//For tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load().(*tls.Certificate), nil
+}
+
+//Expiry of the certificate being served
+func (r *CertReloader) NotAfter() time.Time {
+	return r.cert.Load().(*tls.Certificate).Leaf.NotAfter
+}
+
+//Snapshot for GET /stats
+func (r *CertReloader) Metrics() *CertMetrics {
+	notAfter := r.NotAfter()
+	return &CertMetrics{
+		NotAfter:  notAfter.UTC(),
+		ExpiresIn: int64(time.Until(notAfter).Seconds()),
+		Reloads:   atomic.LoadUint64(&r.reloads),
+		LastError: r.lastErr.Load().(string),
+	}
+}
+
+//TLS settings serving the certificates from src, based on base if not nil
+func certTLSConfig(src certSource, base *tls.Config) *tls.Config {
+	cfg := &tls.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	cfg.GetCertificate = src.GetCertificate
+	if m, ok := src.(*ACMEManager); ok && m.cfg.Challenge == ACMEChallengeTLSALPN01 {
+		//no other client offers it, so it's only ever negotiated with a CA validating a challenge
+		cfg.NextProtos = append(cfg.NextProtos, acmeTLSALPNProto)
+	}
+	return cfg
+}
+
+//Reloads every listener's certificate, eg; on SIGHUP
+func (e *APIEngine) ReloadCertificates() {
+	for name, src := range map[string]certSource{"https": e.certs, "admin": e.adminCerts} {
+		if src == nil {
+			continue
+		}
+		if _, ok := src.(*ACMEManager); ok {
+			infof("Checking whether the %s certificate is due for renewal", name)
+			src.Reload()
+		} else if err := src.Reload(); err != nil {
+			log.Printf("Error: could not reload %s certificate, still serving the previous one: %s", name, err.Error())
+		} else {
+			infof("Reloaded %s certificate, valid until %s", name, src.Metrics().NotAfter.Format(time.RFC3339))
+		}
+	}
+}
+
+//Expiry and reload state of each listener's certificate for GET /stats
+func (e *APIEngine) certMetrics() map[string]*CertMetrics {
+	if e.certs == nil && e.adminCerts == nil {
+		return nil
+	}
+	m := make(map[string]*CertMetrics, 2)
+	if e.certs != nil {
+		m["https"] = e.certs.Metrics()
+	}
+	if e.adminCerts != nil {
+		m["admin"] = e.adminCerts.Metrics()
+	}
+	return m
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jumphasher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.pem")
+	if err := GenSelfSignedCert(key, cert); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewCertReloader(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	first, _ := r.GetCertificate(nil)
+	if m := r.Metrics(); m.Reloads != 1 || m.ExpiresIn <= 0 || !m.NotAfter.Equal(first.Leaf.NotAfter) {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+
+	//a rotated pair is picked up
+	if err := GenSelfSignedCert(key, cert); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := r.GetCertificate(nil)
+	if bytes.Equal(first.Certificate[0], second.Certificate[0]) {
+		t.Error("Reload kept serving the old certificate")
+	}
+
+	//a half-rotated pair is rejected and the previous one kept
+	other := filepath.Join(dir, "other.pem")
+	if err := GenSelfSignedCert(other, filepath.Join(dir, "other.crt")); err != nil {
+		t.Fatal(err)
+	}
+	os.Rename(other, key)
+	if err := r.Reload(); err == nil {
+		t.Error("Expected error for mismatched key")
+	}
+	if current, _ := r.GetCertificate(nil); current != second {
+		t.Error("Mismatched pair was swapped in")
+	}
+	if m := r.Metrics(); m.LastError == "" || m.Reloads != 2 {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+	if r.changed() {
+		t.Error("The watcher would keep retrying a pair that already failed to load")
+	}
+
+	//as is an expired one
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "expired"},
+		NotBefore:    time.Now().Add(-48 * time.Hour),
+		NotAfter:     time.Now().Add(-24 * time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	keyDER, _ := x509.MarshalECPrivateKey(priv)
+	ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err := r.Reload(); err == nil {
+		t.Error("Expected error for expired certificate")
+	}
+	if current, _ := r.GetCertificate(nil); current != second {
+		t.Error("Expired certificate was swapped in")
+	}
+}
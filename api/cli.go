@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/iamthebot/jumphasher/common"
+	"io"
+	"log"
+	"os"
+	"runtime"
+)
+
+//number of records between progress reports for export/import
+const progressInterval = 100000
+
+//Subcommands accepted as the first argument, eg; `jumphasher export -store=file:hashes.log`
+var subcommands = map[string]func(args []string) error{
+	"export": runExport,
+	"import": runImport,
+}
+
+//Parses a dump format name
+func parseDumpFormat(name string) (int, error) {
+	switch name {
+	case "jsonl":
+		return jumphasher.DumpFormatJSON, nil
+	case "binary":
+		return jumphasher.DumpFormatBinary, nil
+	default:
+		return 0, fmt.Errorf("unknown dump format '%s'. Expected 'jsonl' or 'binary'", name)
+	}
+}
+
+//Implements `jumphasher export`: dumps a hash store to a file (or stdout)
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	spec := fs.String("store", "", "store to export from. 'file:<path>'")
+	keyfile := fs.String("keyfile", "", "keyfile the store was encrypted with, if any. Exported hashes are decrypted")
+	format := fs.String("format", "jsonl", "'jsonl' (JSON lines) or 'binary'")
+	out := fs.String("out", "-", "destination file, or '-' for stdout")
+	fs.Parse(args)
+	if *spec == "" {
+		return fmt.Errorf("export: must provide a store via -store")
+	}
+	f, err := parseDumpFormat(*format)
+	if err != nil {
+		return err
+	}
+	s, err := OpenHashStore(*spec, runtime.NumCPU(), *keyfile)
+	if err != nil {
+		return err
+	}
+	defer CloseHashStore(s)
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		//the dump holds plaintext hashes, so it's only readable by us and never overwrites an existing file
+		of, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer of.Close()
+		w = of
+	}
+	n, err := jumphasher.ExportHashStore(s, w, f, progressInterval, func(n uint64) {
+		log.Printf("Exported %d records", n)
+	})
+	if err != nil {
+		return fmt.Errorf("export failed after %d records: %s", n, err.Error())
+	}
+	return nil
+}
+
+//Implements `jumphasher import`: loads a dump from a file (or stdin) into a hash store
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	spec := fs.String("store", "", "store to import into. 'file:<path>'")
+	keyfile := fs.String("keyfile", "", "if set, imported hashes are encrypted at rest with the keys in this file")
+	in := fs.String("in", "-", "source dump file, or '-' for stdin. The format is detected automatically")
+	fs.Parse(args)
+	if *spec == "" {
+		return fmt.Errorf("import: must provide a store via -store")
+	}
+	s, err := OpenHashStore(*spec, runtime.NumCPU(), *keyfile)
+	if err != nil {
+		return err
+	}
+	defer CloseHashStore(s)
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	n, err := jumphasher.ImportHashStore(s, r, progressInterval, func(n uint64) {
+		log.Printf("Imported %d records", n)
+	})
+	if err != nil {
+		return fmt.Errorf("import failed after %d records: %s", n, err.Error())
+	}
+	return nil
+}
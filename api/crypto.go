@@ -4,9 +4,11 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"io/ioutil"
 	"math/big"
 	"os"
@@ -14,10 +16,75 @@ import (
 )
 
 type SSLConfig struct {
-	CertFile  string //path to X509 certificate chain
-	KeyFile   string //path to key file
-	Port      uint   //port to listen on for HTTPS connections
-	Exclusive bool   //if true, do not allow non-HTTPS connections
+	CertFile          string      //path to X509 certificate chain
+	KeyFile           string      //path to key file
+	Port              uint        //port to listen on for HTTPS connections
+	Exclusive         bool        //if true, do not allow non-HTTPS connections
+	ClientCAFile      string      //if not empty, client certificates are verified against the CAs in this PEM file
+	RequireClientCert bool        //if true, clients without a valid certificate are refused during the handshake. Otherwise certificates are optional
+	ClientIdentity    string      //which part of a client certificate identifies the client. ClientIdentitySubject or ClientIdentitySAN
+	ACME              *ACMEConfig //if not nil, the certificate is obtained from an ACME CA instead of CertFile and KeyFile
+}
+
+//Parts of a client certificate that can identify the client
+const (
+	ClientIdentitySubject = "subject" //the subject's common name
+	ClientIdentitySAN     = "san"     //the first URI, DNS or email subject alternative name, in that order
+)
+
+//TLS settings for verifying client certificates. Returns nil if client certificates aren't enabled
+func (c *SSLConfig) clientTLSConfig() (*tls.Config, error) {
+	if c.ClientCAFile == "" {
+		return nil, nil
+	}
+	switch c.ClientIdentity {
+	case "":
+		c.ClientIdentity = ClientIdentitySubject
+	case ClientIdentitySubject, ClientIdentitySAN:
+	default:
+		return nil, fmt.Errorf("client identity must be '%s' or '%s'", ClientIdentitySubject, ClientIdentitySAN)
+	}
+	pool, err := loadCertPool(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.RequireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+//Identity of a verified client certificate, or the empty string if it doesn't carry the configured one
+func certIdentity(cert *x509.Certificate, mode string) string {
+	if mode == ClientIdentitySAN {
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		} else if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		} else if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+//Loads every certificate in a PEM file into a pool, for verifying clients
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return pool, nil
 }
 
 //Generates a self-signed X509 certificate and keypair using ECDSA with NIST P-256 curve
@@ -1,65 +1,288 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/iamthebot/jumphasher/common"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
-	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+//Default cap on how long GET /hash may block when a client asks to wait
+const DefaultMaxWait = 60 * time.Second
+
+//Default cap on per-request delays
+const DefaultMaxDelay = 24 * time.Hour
+
+//Default time Stop gives in-flight requests to complete
+const DefaultDrainTimeout = 30 * time.Second
+
+//Default number of requests buffered per worker
+const DefaultQueueSize = 64
+
+//Default time a request may wait for room in the worker queue before it's shed
+const DefaultEnqueueTimeout = 100 * time.Millisecond
+
+//Seconds clients are told to back off for when their request is shed
+const shedRetryAfter = 1
+
+var ErrShuttingDown error = errors.New("server is shutting down")
+
+var ErrQueueFull error = errors.New("server is overloaded, retry later")
+
+var ErrDelayOutOfRange error = errors.New("requested delay is outside the range allowed by the server")
+
 //Central API engine
 //
 //Responsible for dispatching work, etc.
 type APIEngine struct {
-	store    jumphasher.HashStore   //holds our hashes
-	metrics  MetricsEngine          //keeps track of metrics
-	inChans  []chan *HashingRequest //used to route hashing requests to our workers
-	alive    jumphasher.AtomicFlag  //used to coordinate shutdown
-	sslcfg   *SSLConfig             //ssl configuration. If nil, SSL is disabled
-	port     int                    //port to listen on
-	delay    int                    //number of seconds to delay hashing requests
-	hashType int                    //hashing engine to use
-	wg       sync.WaitGroup         //used to coordinate shutdown for workers
+	shed         int64                               //requests rejected because the worker queue stayed full. Accessed atomically, so kept first for alignment
+	pool         workerPool                          //sizing and load statistics for the hashing workers
+	store        jumphasher.HashStore                //holds our hashes
+	metrics      MetricsEngine                       //keeps track of metrics
+	queues       [numPriorities]chan *HashingRequest //one per priority class, shared by every worker so whichever is free picks up the next request
+	classes      [numPriorities]classStats           //per priority class counters
+	alive        jumphasher.AtomicFlag               //used to coordinate shutdown
+	sslcfg       *SSLConfig                          //ssl configuration. If nil, SSL is disabled
+	port         int                                 //port to listen on
+	delay        time.Duration                       //default delay before hashing results become available
+	minDelay     time.Duration                       //lower bound on per-request delays
+	maxDelay     time.Duration                       //upper bound on per-request delays
+	hashType     int                                 //hashing engine to use
+	maxWait      time.Duration                       //longest a client may block on GET /hash
+	maxBatch     int                                 //most passwords accepted by one POST /hash/batch
+	queueSize    int                                 //requests buffered per worker
+	enqueueTO    time.Duration                       //how long a request may wait for room in the worker queue
+	events       *EventBus                           //job state transitions for GET /events
+	heartbeat    time.Duration                       //interval between heartbeats on idle event streams
+	webhooks     *WebhookDispatcher                  //delivers completion callbacks. If nil, webhooks are disabled
+	scheduler    *DelayScheduler                     //holds hashed jobs until their delay elapses
+	journal      *JobJournal                         //durable record of accepted jobs. If nil, jobs pending at exit are lost
+	cancelled    *cancelledJobs                      //recently cancelled jobs, so GET /hash can report them
+	wg           sync.WaitGroup                      //used to coordinate shutdown for workers
+	mux          *http.ServeMux                      //routes API requests
+	handler      http.Handler                        //mux, behind API key authentication if enabled
+	keys         *APIKeys                            //if nil, the API is open and every request belongs to the default tenant
+	tenantSecret []byte                              //server secret tenants' job IDs are mapped under
+	limiter      *RateLimiter                        //rate limits and quotas for hashing requests
+	audit        *AuditLog                           //if nil, requests aren't audited
+	certs        certSource                          //certificate served over HTTPS. If nil, HTTPS is disabled
+	acme         *ACMEManager                        //obtains certs from an ACME CA, if configured
+	adminCerts   certSource                          //certificate served by the admin listener. If nil, it uses plain HTTP
+	httpSrv      *http.Server                        //plain HTTP listener. If nil, only HTTPS is served
+	httpsSrv     *http.Server                        //HTTPS listener. If nil, only plain HTTP is served
+	drainTO      time.Duration                       //how long Stop waits for in-flight requests
+	stopping     chan struct{}                       //closed when shutdown begins, ending long polls and event streams
+	stopped      chan struct{}                       //closed once shutdown completes
+	stopOnce     sync.Once
+	submitLock   sync.RWMutex   //held for reading while a handler queues a request, and for writing to set closed
+	closed       bool           //if true, the worker queues are closed and submit turns requests away
+	admin        *AdminConfig   //admin listener settings. If nil, admin operations are disabled
+	adminMux     *http.ServeMux //routes admin requests
+	adminSrv     *http.Server   //admin listener
+}
+
+//Settings for a new API engine
+type EngineConfig struct {
+	Concurrency    int                  //desired concurrency
+	HashType       int                  //hash function
+	SSL            *SSLConfig           //SSL/TLS configuration if applicable
+	Port           int                  //port to listen on
+	Delay          time.Duration        //default delay before each hashing result becomes available
+	MinDelay       time.Duration        //lower bound on per-request 'delay' and 'available_at'
+	MaxDelay       time.Duration        //upper bound on per-request 'delay' and 'available_at'. If 0, DefaultMaxDelay is used
+	Store          jumphasher.HashStore //where to persist hashes. If nil, an in-memory store is used
+	MaxWait        time.Duration        //cap on the 'wait' parameter of GET /hash. If 0, DefaultMaxWait is used
+	EventBuffer    int                  //number of job events kept for GET /events resume. If 0, DefaultEventBuffer is used
+	Webhooks       *WebhookConfig       //webhook delivery settings. If nil, callback_url is rejected
+	MaxBacklog     int                  //maximum jobs waiting out their delay. If 0, DefaultMaxBacklog is used
+	JournalPath    string               //if not empty, accepted jobs are journaled here and replayed on startup. Hashes are sealed if Store seals them
+	MaxBatch       int                  //most passwords accepted by one POST /hash/batch. If 0, DefaultMaxBatch is used
+	MinWorkers     int                  //fewest hashing workers the autoscaler may shrink to. If 0, Concurrency is used
+	MaxWorkers     int                  //most hashing workers the autoscaler may grow to. If 0, Concurrency is used
+	QueueSize      int                  //requests buffered per worker. QueueSize × MaxWorkers are buffered in all, split evenly between the priority classes. If 0, DefaultQueueSize is used
+	Admin          *AdminConfig         //admin listener settings. If nil, admin operations are disabled
+	DrainTimeout   time.Duration        //how long Stop waits for in-flight requests before closing connections. If 0, DefaultDrainTimeout is used
+	EnqueueTimeout time.Duration        //how long a request may wait for room in the worker queue before a 429. If 0, DefaultEnqueueTimeout is used
+	APIKeys        *APIKeys             //if set, public requests must carry one of these keys and are scoped to its tenant. Closed by Stop
+	TenantSecret   []byte               //server secret tenants' job IDs are mapped under. Needed with APIKeys or client certificates, and must match the one APIKeys was loaded with
+	AuditLogPath   string               //if not empty, every request is recorded here as a JSON line
+	RateLimits     RateLimits           //initial rate limits for hashing requests. Can be changed at runtime via POST /admin/ratelimits
+}
+
+//Settings for webhook delivery
+type WebhookConfig struct {
+	Secret      []byte       //HMAC-SHA256 key used to sign payloads
+	Attempts    int          //delivery attempts before a webhook is dead-lettered
+	Concurrency int          //maximum concurrent requests to a single destination
+	DeadLetters int          //number of dead letters to remember
+	Allow       []*net.IPNet //loopback, link-local or private networks callbacks may reach anyway
 }
 
 //Initializes a new API engine
-//
-//c: Desired concurrency
-//
-//hf: Hash function
-//
-//sslcfg: SSL/TLS configuration if applicable
-//
-//port: Port to listen on
-//
-//delay: Number of seconds to delay each hashing request
-func NewAPIEngine(c int, hf int, sslcfg *SSLConfig, port int, delay int) (*APIEngine, error) {
+func NewAPIEngine(cfg EngineConfig) (_ *APIEngine, err error) {
 	var e APIEngine
-	e.inChans = make([]chan *HashingRequest, c)
+	defer func() {
+		if err != nil {
+			e.release()
+		}
+	}()
+	if err := e.pool.init(cfg.Concurrency, cfg.MinWorkers, cfg.MaxWorkers); err != nil {
+		return nil, err
+	}
 	e.alive.Clear()
-	e.sslcfg = sslcfg
-	e.hashType = hf
-	e.port = port
-	e.delay = delay
-	e.store = jumphasher.NewMemHashStore(c)
+	e.sslcfg = cfg.SSL
+	e.hashType = cfg.HashType
+	e.port = cfg.Port
+	e.delay = cfg.Delay
+	e.minDelay = cfg.MinDelay
+	e.maxDelay = cfg.MaxDelay
+	if e.maxDelay == 0 {
+		e.maxDelay = DefaultMaxDelay
+	}
+	if e.delay < e.minDelay || e.delay > e.maxDelay {
+		return nil, fmt.Errorf("default delay %s must be between %s and %s", e.delay, e.minDelay, e.maxDelay)
+	}
+	e.store = cfg.Store
+	if e.store == nil {
+		e.store = jumphasher.NewMemHashStore(cfg.Concurrency)
+	}
+	e.maxWait = cfg.MaxWait
+	if e.maxWait == 0 {
+		e.maxWait = DefaultMaxWait
+	}
+	e.maxBatch = cfg.MaxBatch
+	if e.maxBatch == 0 {
+		e.maxBatch = DefaultMaxBatch
+	}
+	e.queueSize = cfg.QueueSize
+	if e.queueSize == 0 {
+		e.queueSize = DefaultQueueSize
+	}
+	e.enqueueTO = cfg.EnqueueTimeout
+	if e.enqueueTO == 0 {
+		e.enqueueTO = DefaultEnqueueTimeout
+	}
+	//the classes split the buffer between them, rounding up so none is left without room
+	perClass := (e.queueSize*e.pool.max + int(numPriorities) - 1) / int(numPriorities)
+	for p := range e.queues {
+		e.queues[p] = make(chan *HashingRequest, perClass)
+	}
+	if cfg.EventBuffer == 0 {
+		cfg.EventBuffer = DefaultEventBuffer
+	}
+	e.events = NewEventBus(cfg.EventBuffer)
+	e.heartbeat = eventHeartbeat
+	if cfg.MaxBacklog == 0 {
+		cfg.MaxBacklog = DefaultMaxBacklog
+	}
+	e.scheduler = NewDelayScheduler(cfg.MaxBacklog, e.persist)
+	e.cancelled = newCancelledJobs(cancelledJobsRemembered)
+	if cfg.Webhooks != nil {
+		e.webhooks = NewWebhookDispatcher(cfg.Webhooks.Secret, cfg.Webhooks.Attempts, cfg.Webhooks.Concurrency, cfg.Webhooks.DeadLetters, cfg.Webhooks.Allow)
+	}
+	e.drainTO = cfg.DrainTimeout
+	if e.drainTO == 0 {
+		e.drainTO = DefaultDrainTimeout
+	}
+	e.stopping = make(chan struct{})
+	e.stopped = make(chan struct{})
+	e.keys = cfg.APIKeys
+	e.tenantSecret = cfg.TenantSecret
+	if (e.keys != nil || (e.sslcfg != nil && e.sslcfg.ClientCAFile != "")) && len(e.tenantSecret) < minTenantSecretLength {
+		return nil, ErrWeakTenantSecret
+	}
+	e.limiter = NewRateLimiter(cfg.RateLimits)
+	if cfg.AuditLogPath != "" {
+		audit, err := OpenAuditLog(cfg.AuditLogPath)
+		if err != nil {
+			return nil, err
+		}
+		e.audit = audit
+	}
+	e.routes()
+	if cfg.Admin != nil {
+		if err := e.initAdmin(cfg.Admin); err != nil {
+			return nil, err
+		}
+	}
+	if e.sslcfg != nil && e.sslcfg.RequireClientCert && !e.sslcfg.Exclusive {
+		return nil, errors.New("requiring client certificates needs HTTPS only, or plain HTTP clients would get around it")
+	}
+	if e.sslcfg == nil || !e.sslcfg.Exclusive {
+		e.httpSrv = &http.Server{Addr: fmt.Sprintf(":%d", e.port), Handler: e.handler}
+	}
+	if e.sslcfg != nil {
+		e.httpsSrv = &http.Server{Addr: fmt.Sprintf(":%d", e.sslcfg.Port), Handler: e.handler}
+		tlsCfg, err := e.sslcfg.clientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		if e.sslcfg.ACME != nil {
+			if e.sslcfg.ACME.Challenge == ACMEChallengeHTTP01 && e.httpSrv == nil {
+				return nil, errors.New("the ACME http-01 challenge is answered on the plain HTTP port, which sslmode=exclusive disables")
+			}
+			if e.acme, err = NewACMEManager(*e.sslcfg.ACME); err != nil {
+				return nil, err
+			}
+			e.certs = e.acme
+			if e.httpSrv != nil {
+				e.httpSrv.Handler = e.acme.HTTPHandler(e.httpSrv.Handler)
+			}
+		} else {
+			certs, err := NewCertReloader(e.sslcfg.CertFile, e.sslcfg.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			e.certs = certs
+		}
+		e.httpsSrv.TLSConfig = certTLSConfig(e.certs, tlsCfg)
+	}
+	//replayed jobs may already be due, so everything they touch has to be set up first. They're flushed once Start runs the scheduler
+	if cfg.JournalPath != "" {
+		journal, pending, err := OpenJobJournal(cfg.JournalPath, storeKeyring(e.store), e.tenantSecret)
+		if err != nil {
+			return nil, err
+		}
+		e.journal = journal
+		for _, j := range pending {
+			e.scheduler.Restore(j)
+		}
+		if len(pending) > 0 {
+			infof("Recovered %d pending jobs from %s", len(pending), cfg.JournalPath)
+		}
+	}
 	return &e, nil
 }
 
-func (e *APIEngine) Start() {
-	for i := 0; i < len(e.inChans); i++ {
-		e.inChans[i] = make(chan *HashingRequest)
-		go e.worker(e.inChans[i])
+//Releases whatever NewAPIEngine had set up when it fails part way through
+func (e *APIEngine) release() {
+	if e.webhooks != nil {
+		e.webhooks.Close()
+	}
+	for _, r := range []certSource{e.certs, e.adminCerts} {
+		if r != nil {
+			r.Close()
+		}
+	}
+	if e.audit != nil {
+		e.audit.Close()
 	}
+}
 
-	//set up handlers for default muxer
-	http.HandleFunc("/hash", func(w http.ResponseWriter, req *http.Request) {
+//Registers route handlers on the engine's own muxer
+func (e *APIEngine) routes() {
+	e.mux = http.NewServeMux()
+	e.mux.HandleFunc("/hash", func(w http.ResponseWriter, req *http.Request) {
 		switch req.Method {
 		case "GET":
 			e.onHashGet(w, req)
@@ -69,75 +292,197 @@ func (e *APIEngine) Start() {
 			http.Error(w, fmt.Sprintf("Unsupported method: %s", req.Method), 405)
 		}
 	})
-	http.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
+	e.mux.HandleFunc("/hash/sync", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, fmt.Sprintf("Unsupported method: %s", req.Method), 405)
+			return
+		}
+		e.onHashPost(w, req)
+	})
+	e.mux.HandleFunc("/hash/batch", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, fmt.Sprintf("Unsupported method: %s", req.Method), 405)
+			return
+		}
+		e.onHashBatchPost(w, req)
+	})
+	e.mux.HandleFunc("/jobs/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, fmt.Sprintf("Unsupported method: %s", req.Method), 405)
+			return
+		}
+		e.onJobCancelPost(w, req)
+	})
+	e.mux.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
 		if req.Method != "GET" {
 			http.Error(w, fmt.Sprintf("Unsupported method: %s", req.Method), 405)
 			return
 		}
 		e.onStatsGet(w, req)
 	})
-	http.HandleFunc("/shutdown", func(w http.ResponseWriter, req *http.Request) {
+	e.mux.HandleFunc("/events", func(w http.ResponseWriter, req *http.Request) {
 		if req.Method != "GET" {
 			http.Error(w, fmt.Sprintf("Unsupported method: %s", req.Method), 405)
 			return
 		}
-		e.onShutdownGet(w, req)
+		e.onEventsGet(w, req)
 	})
-	if e.sslcfg != nil {
-		e.alive.TestAndSet()
-		if !e.sslcfg.Exclusive { //dispatch TLS listener asynchronously and block on normal HTTP server
-			go func() {
-				log.Printf("Server now accepting https connections at port %d", e.sslcfg.Port)
-				err := http.ListenAndServeTLS(fmt.Sprintf(":%d", e.sslcfg.Port), e.sslcfg.CertFile, e.sslcfg.KeyFile, nil)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}()
-			log.Printf("Server now accepting http connections at port %d", e.port)
-			err := http.ListenAndServe(fmt.Sprintf(":%d", e.port), nil)
-			if err != nil {
-				log.Fatal(err)
-			}
-		} else { //block on TLS listener
-			log.Printf("Server now accepting SSL connections at port %d", e.port)
-			err := http.ListenAndServeTLS(fmt.Sprintf(":%d", e.sslcfg.Port), e.sslcfg.CertFile, e.sslcfg.KeyFile, nil)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-	} else { //block on HTTP server
-		e.alive.TestAndSet()
-		log.Printf("Server now accepting http connections at port %d", e.port)
-		err := http.ListenAndServe(fmt.Sprintf(":%d", e.port), nil)
-		if err != nil {
-			log.Fatal(err)
+	e.handler = e.mux
+	if e.keys != nil || (e.sslcfg != nil && e.sslcfg.ClientCAFile != "") {
+		e.handler = e.authenticate(e.mux)
+	}
+	e.handler = e.audited(e.handler)
+}
+
+//Handler serving the API, for embedding the engine in another server
+func (e *APIEngine) Handler() http.Handler {
+	return e.handler
+}
+
+//Starts the workers and listeners, then blocks until the engine has been stopped
+//
+//Returns nil after a graceful shutdown via Stop, or the error that brought a listener down
+func (e *APIEngine) Start() error {
+	e.startWorkers()
+	e.alive.TestAndSet()
+	errs := make(chan error, 3)
+	listeners := 0
+	if e.httpSrv != nil {
+		listeners++
+		go func() {
+			infof("Server now accepting http connections at port %d", e.port)
+			errs <- e.httpSrv.ListenAndServe()
+		}()
+	}
+	if e.httpsSrv != nil {
+		listeners++
+		go func() {
+			infof("Server now accepting https connections at port %d", e.sslcfg.Port)
+			errs <- e.httpsSrv.ListenAndServeTLS("", "")
+		}()
+	}
+	if e.adminSrv != nil {
+		listeners++
+		go e.serveAdmin(errs)
+	}
+	if e.acme != nil {
+		//the CA validates challenges against the listeners, so they must be up first
+		e.acme.Start()
+	}
+	var first error
+	for i := 0; i < listeners; i++ {
+		if err := <-errs; err != http.ErrServerClosed && first == nil {
+			//take the rest of the engine down with it
+			first = err
+			go e.Stop()
 		}
 	}
+	<-e.stopped
+	return first
+}
+
+//Spins up the initial hashing workers, the autoscaler if the pool is allowed to change size, and the delay scheduler
+func (e *APIEngine) startWorkers() {
+	e.scheduler.Start()
+	for i := 0; i < e.pool.initial; i++ {
+		e.startWorker()
+	}
+	if e.pool.min < e.pool.max {
+		e.pool.scaling = true
+		go e.autoscale()
+	}
+}
+
+//Adds a hashing worker to the pool
+func (e *APIEngine) startWorker() {
+	atomic.AddInt64(&e.pool.workers, 1)
+	e.wg.Add(1)
+	go e.worker()
 }
 
-//Gracefully shut down API engine
+//Gracefully shuts down the API engine, returning once everything has been flushed
 //
-//First, declares a shutdown state so further requests are rejected
+//First, rejects new hashing requests and stops accepting connections, giving in-flight requests up to drainTO
+//to complete. Long polls and event streams are ended straight away.
 //
-//Finally, waits for workers to finish
+//Then closes the worker queues once no handler can send to them, and waits for workers to finish.
+//
+//Finally, deals with delayed jobs. With a journal, jobs still waiting out their delay are left in it for the next start.
+//Without one, they're persisted straight away rather than waited on, since they may not be due for up to maxDelay.
+//Safe to call more than once, and from several goroutines
 func (e *APIEngine) Stop() {
-	//enable the shutdown flag to prevent conflicts
+	e.stopOnce.Do(e.stop)
+	<-e.stopped
+}
+
+func (e *APIEngine) stop() {
+	defer close(e.stopped)
+	//enable the shutdown flag so new requests are turned away
 	e.alive.Clear()
-	//add a short timeout to allow open HTTP responses to complete
-	time.Sleep(1)
-	//close worker channels
-	for _, c := range e.inChans {
-		close(c)
+	close(e.stopping)
+	//let in-flight requests complete
+	ctx, cancel := context.WithTimeout(context.Background(), e.drainTO)
+	defer cancel()
+	var servers sync.WaitGroup
+	for _, srv := range []*http.Server{e.httpSrv, e.httpsSrv, e.adminSrv} {
+		if srv == nil {
+			continue
+		}
+		servers.Add(1)
+		go func(srv *http.Server) {
+			defer servers.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Error: requests still in flight after %s. Closing their connections: %s", e.drainTO, err.Error())
+				srv.Close()
+			}
+		}(srv)
+	}
+	servers.Wait()
+	//no handler can queue requests past this point
+	e.submitLock.Lock()
+	e.closed = true
+	e.submitLock.Unlock()
+	//stop resizing the pool, then close the worker queues
+	e.pool.stopScaling()
+	for _, q := range e.queues {
+		close(q)
 	}
 	//wait for workers to finish
-	log.Println("Waiting for workers to finish...")
+	infof("Waiting for workers to finish...")
 	e.wg.Wait()
-	os.Exit(0)
+	if e.journal != nil {
+		infof("Leaving %d delayed jobs in the journal for the next start", e.scheduler.Abandon())
+		if err := e.journal.Close(); err != nil {
+			log.Printf("Error: could not close job journal: %s", err.Error())
+		}
+	} else {
+		infof("Persisting %d delayed jobs ahead of their delay...", e.scheduler.Len())
+		e.scheduler.Flush()
+	}
+	if e.webhooks != nil {
+		e.webhooks.Close()
+	}
+	if e.keys != nil {
+		e.keys.Close()
+	}
+	for _, r := range []certSource{e.certs, e.adminCerts} {
+		if r != nil {
+			r.Close()
+		}
+	}
+	if e.audit != nil {
+		if err := e.audit.Close(); err != nil {
+			log.Printf("Error: could not close audit log: %s", err.Error())
+		}
+	}
+	if err := CloseHashStore(e.store); err != nil {
+		log.Printf("Error: could not close hash store: %s", err.Error())
+	}
+	infof("Shutdown complete")
 }
 
-//Handles incoming work requests for hashing and dispatches async persistence tasks
-func (e *APIEngine) worker(c chan *HashingRequest) {
-	e.wg.Add(1)
+//Handles incoming work requests for hashing until the queues are closed or the worker is retired by the autoscaler
+func (e *APIEngine) worker() {
 	defer e.wg.Done()
 	var he jumphasher.HashingEngine
 	switch e.hashType { //we can extend this with more hash functions
@@ -146,49 +491,145 @@ func (e *APIEngine) worker(c chan *HashingRequest) {
 	default:
 		log.Fatal("Unknown hash function")
 	}
-	for r := range c {
-		//hash the request
-		h, err := he.Hash(r.Password)
-		if err != nil {
+	queues := e.queues
+	pos := 0
+	for {
+		r := e.nextRequest(&queues, &pos)
+		if r == nil {
+			return
+		}
+		e.observeServed(r)
+		start := time.Now()
+		e.handle(he, r)
+		e.pool.observeBusy(time.Since(start))
+	}
+}
+
+//Hashes a single request and dispatches async persistence tasks, replying on r.ReturnChan
+func (e *APIEngine) handle(he jumphasher.HashingEngine, r *HashingRequest) {
+	//hash the request
+	start := time.Now()
+	h, err := he.Hash(r.Password)
+	e.pool.observeHash(time.Since(start))
+	if err != nil {
+		r.ReturnChan <- err
+		return
+	}
+	if r.Sync {
+		//hand the hash straight back, only recording it if asked to
+		r.Hash = h
+		if r.Store {
+			e.events.Publish(r.Tenant, &r.ID, JobStateAccepted)
+			err = e.persistJob(&ScheduledJob{ID: r.ID, Hash: h, Tenant: r.Tenant})
+		}
+		r.ReturnChan <- err
+		return
+	}
+	//schedule persistence once the delay elapses
+	job := &ScheduledJob{
+		ID:          r.ID,
+		Hash:        h,
+		Due:         r.AvailableAt,
+		CallbackURL: r.CallbackURL,
+		Tenant:      r.Tenant,
+	}
+	if job.Due.IsZero() {
+		job.Due = time.Now().Add(r.Delay)
+	}
+	if !job.Due.After(time.Now()) {
+		//nothing to wait for. Store it before acknowledging so the client can fetch it straight away
+		e.events.Publish(r.Tenant, &r.ID, JobStateAccepted)
+		r.ReturnChan <- e.persistJob(job)
+		return
+	}
+	//the job must be durable before we acknowledge it
+	if e.journal != nil {
+		if err := e.journal.Append(job); err != nil {
 			r.ReturnChan <- err
 			return
 		}
-		//dispatch async persistence job
-		go e.persist(&r.ID, h, e.delay)
-		r.ReturnChan <- nil
 	}
+	if err := e.scheduler.Schedule(job); err != nil {
+		if e.journal != nil {
+			e.journal.Done(&job.ID)
+		}
+		r.ReturnChan <- err
+		return
+	}
+	e.events.Publish(r.Tenant, &r.ID, JobStateAccepted)
+	r.ReturnChan <- nil
 }
 
-//Persists hashing result asynchronously
+//Stores a single job's hash and announces its completion
+func (e *APIEngine) persistJob(j *ScheduledJob) error {
+	err := e.store.Store(&j.ID, j.Hash)
+	if err != nil {
+		log.Printf("Error: job %s could not be stored", j.ID.MarshalText())
+		return err
+	}
+	e.events.Publish(j.Tenant, &j.ID, JobStateCompleted)
+	if j.CallbackURL != "" && e.webhooks == nil {
+		//accepted by a previous run that had webhooks enabled
+		log.Printf("Error: dropping webhook for job %s: webhooks are disabled", j.ID.MarshalText())
+	} else if j.CallbackURL != "" {
+		if err := e.webhooks.Enqueue(j.CallbackURL, j.Tenant, &j.ID, j.Hash); err != nil {
+			log.Printf("Error: could not queue webhook for job %s: %s", j.ID.MarshalText(), err.Error())
+		}
+	}
+	return nil
+}
+
+//Persists jobs whose delay has elapsed, making them available via GET /hash
 //
-//delay controls the number of seconds before the ID is persisted and the result is available via GET /hash
-func (e *APIEngine) persist(id *jumphasher.UUID, hash []byte, delay int) {
-	e.wg.Add(1)
-	if delay != 0 {
-		time.Sleep(time.Duration(int64(delay) * int64(time.Second)))
+//Called from the scheduler's run loop. Each job is stored with its own Store call. Only the store sync and the
+//journal's done records are shared by the whole batch
+func (e *APIEngine) persist(jobs []*ScheduledJob) {
+	stored := make([]*jumphasher.UUID, 0, len(jobs))
+	for _, j := range jobs {
+		//failed jobs are left in the journal so they're retried on the next start
+		if e.persistJob(j) == nil {
+			stored = append(stored, &j.ID)
+		}
 	}
-	err := e.store.Store(id, hash)
-	if err != nil {
-		log.Printf("Error: job %s could not be stored", id.MarshalText())
+	if e.journal == nil || len(stored) == 0 {
+		return
+	}
+	//make sure the hashes are durable before we forget about the jobs
+	if err := SyncHashStore(e.store); err != nil {
+		log.Printf("Error: could not sync hash store: %s", err.Error())
+		return
+	}
+	if err := e.journal.Done(stored...); err != nil {
+		log.Printf("Error: could not mark %d jobs done in journal: %s", len(stored), err.Error())
 	}
-	e.wg.Done()
 }
 
-//route handler for POST /hash
+//route handler for POST /hash and POST /hash/sync
+//
+//By default the job is accepted asynchronously and its ID returned. With sync=true (or via /hash/sync)
+//the base 64 encoded hash is returned directly instead, and is only recorded in the store if store=true
 func (e *APIEngine) onHashPost(w http.ResponseWriter, req *http.Request) {
 	//if the API is shutting down, we need to immediately return a 503
 	if !e.alive.Test() {
 		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
 		return
 	}
+	if !e.rateLimit(w, req) {
+		return
+	}
 	start := time.Now()
 	defer req.Body.Close()
+	synchronous := req.URL.Path == "/hash/sync" || req.URL.Query().Get("sync") == "true"
+	tmpl, err := e.parseHashOptions(req, synchronous)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	password, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	rc := make(chan error)
 
 	//generate Job ID
 	id, err := jumphasher.UUIDv4()
@@ -197,50 +638,229 @@ func (e *APIEngine) onHashPost(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	//figure out where to route the request
-	worker_id := binary.LittleEndian.Uint32(id[0:4]) % uint32(len(e.inChans))
-	r := HashingRequest{
-		ID:         *id,
-		Password:   password,
-		ReturnChan: rc,
-	}
-	e.inChans[worker_id] <- &r
-
-	//wait on the response
-	err = <-rc
+	r := *tmpl
+	r.ID = r.Tenant.JobKey(id)
+	r.Password = password
+	err = e.submit(&r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeSubmitError(w, err)
 		return
 	}
-	close(rc)
 
 	strid := id.MarshalText()
-	w.WriteHeader(http.StatusOK)
+	body := strid
 	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(strid)))
-	io.WriteString(w, strid)
+	if synchronous {
+		body = base64.StdEncoding.EncodeToString(r.Hash)
+		if r.Store {
+			w.Header().Set("X-Job-ID", strid)
+		}
+	}
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, body)
 	elapsed := time.Since(start)
 	e.metrics.AddDuration(elapsed.Nanoseconds())
 }
 
+//Parses the options shared by every hashing request in a POST, returning them as a template request
+//
+//synchronous: whether the request is for synchronous hashing, which doesn't allow scheduling options
+func (e *APIEngine) parseHashOptions(req *http.Request, synchronous bool) (*HashingRequest, error) {
+	q := req.URL.Query()
+	var r HashingRequest
+	r.Tenant = requestTenant(req)
+	r.Sync = synchronous
+	r.Store = synchronous && q.Get("store") == "true"
+	r.CallbackURL = q.Get("callback_url")
+	if synchronous {
+		if r.CallbackURL != "" || q.Get("delay") != "" || q.Get("available_at") != "" {
+			return nil, errors.New("'callback_url', 'delay' and 'available_at' can't be used with synchronous hashing")
+		}
+	} else if r.CallbackURL != "" {
+		if e.webhooks == nil {
+			return nil, errors.New("webhooks are disabled on this server")
+		}
+		if _, err := e.webhooks.ValidateCallbackURL(r.CallbackURL); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	r.Priority = tenantPriority(r.Tenant)
+	if strp := req.Header.Get(PriorityHeader); strp != "" {
+		if r.Priority, err = ParsePriority(strp); err != nil {
+			return nil, err
+		}
+		//a tenant may ask for a lower class than its key gives it, but not a higher one
+		if ceiling := tenantMaxPriority(r.Tenant); r.Priority < ceiling {
+			r.Priority = ceiling
+		}
+	}
+	r.Delay, r.AvailableAt, err = e.requestDelay(req)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+//Queues a hashing request for the next free worker and waits for it to be handled
+//
+//Requests used to be pinned to a worker by job ID, so a single slow hash held up everything queued behind it
+//even while other workers sat idle. With shared queues a slow request only ties up the worker handling it.
+//Each priority class has its own queue, so a flood of bulk requests can't crowd interactive ones out of the queue either
+func (e *APIEngine) submit(r *HashingRequest) error {
+	e.submitLock.RLock()
+	defer e.submitLock.RUnlock()
+	if e.closed {
+		return ErrShuttingDown
+	}
+	r.ReturnChan = make(chan error)
+	r.Enqueued = time.Now()
+	queue := e.queues[r.Priority]
+	select {
+	case queue <- r:
+	default:
+		//the queue is full. Give the workers a little while to catch up before shedding the request
+		timer := time.NewTimer(e.enqueueTO)
+		select {
+		case queue <- r:
+			timer.Stop()
+		case <-timer.C:
+			atomic.AddInt64(&e.shed, 1)
+			atomic.AddInt64(&e.classes[r.Priority].shed, 1)
+			debugf("Shed %s request after waiting %s for room in the worker queue", r.Priority, e.enqueueTO)
+			return ErrQueueFull
+		}
+	}
+
+	//wait on the response
+	err := <-r.ReturnChan
+	close(r.ReturnChan)
+	return err
+}
+
+//HTTP status to respond with when submit fails
+func submitErrorStatus(err error) int {
+	switch err {
+	case ErrQueueFull:
+		return http.StatusTooManyRequests
+	case ErrSchedulerFull, ErrSchedulerClosed, ErrShuttingDown:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+//Responds to a request that submit failed on
+func writeSubmitError(w http.ResponseWriter, err error) {
+	status := submitErrorStatus(err)
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", strconv.Itoa(shedRetryAfter))
+	}
+	http.Error(w, err.Error(), status)
+}
+
+//Number of requests waiting for a worker
+func (e *APIEngine) queueDepth() int {
+	n := 0
+	for _, q := range e.queues {
+		n += len(q)
+	}
+	return n
+}
+
+//Works out when a POST /hash result should become available
+//
+//Clients may pass either 'delay' (seconds, or a duration like 1500ms) or 'available_at' (an RFC 3339 timestamp).
+//Either way the implied delay must lie within [minDelay, maxDelay]. Without either, the server default applies
+func (e *APIEngine) requestDelay(req *http.Request) (time.Duration, time.Time, error) {
+	q := req.URL.Query()
+	strdelay, strat := q.Get("delay"), q.Get("available_at")
+	if strdelay != "" && strat != "" {
+		return 0, time.Time{}, errors.New("provide at most one of 'delay' and 'available_at'")
+	}
+	if strdelay != "" {
+		d, err := parseDelay(strdelay)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		if d < e.minDelay || d > e.maxDelay {
+			return 0, time.Time{}, fmt.Errorf("%s: 'delay' must be between %s and %s", ErrDelayOutOfRange.Error(), e.minDelay, e.maxDelay)
+		}
+		return d, time.Time{}, nil
+	}
+	if strat != "" {
+		at, err := time.Parse(time.RFC3339, strat)
+		if err != nil {
+			return 0, time.Time{}, errors.New("'available_at' must be an RFC 3339 timestamp, eg; 2017-04-07T15:16:19Z")
+		}
+		d := time.Until(at)
+		if d < 0 {
+			d = 0
+		}
+		if d < e.minDelay || d > e.maxDelay {
+			return 0, time.Time{}, fmt.Errorf("%s: 'available_at' must be between %s and %s from now", ErrDelayOutOfRange.Error(), e.minDelay, e.maxDelay)
+		}
+		return d, at, nil
+	}
+	return e.delay, time.Time{}, nil
+}
+
+//Parses a delay given either as a whole number of seconds or as a Go duration
+func parseDelay(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, errors.New("'delay' must be a non-negative number of seconds or a duration, eg; 1500ms")
+	}
+	return d, nil
+}
+
 //route handler for GET /hash
+//
+//If the optional 'wait' parameter is given (eg; wait=30s), blocks until the hash is available,
+//the wait elapses or the client goes away. Waits are capped at maxWait
+//
+//Jobs cancelled via POST /jobs/{id}/cancel get a 410 instead of a 404
 func (e *APIEngine) onHashGet(w http.ResponseWriter, req *http.Request) {
 	strid := req.URL.Query().Get("id")
 	if strid == "" {
 		http.Error(w, "must provide a job ID via the 'id' parameter", http.StatusBadRequest)
 		return
 	}
-	var u jumphasher.UUID
-	err := u.UnmarshalText(strid)
+	var clientID jumphasher.UUID
+	err := clientID.UnmarshalText(strid)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	u := requestTenant(req).JobKey(&clientID)
+	var wait time.Duration
+	if strwait := req.URL.Query().Get("wait"); strwait != "" {
+		wait, err = time.ParseDuration(strwait)
+		if err != nil || wait < 0 {
+			http.Error(w, "'wait' must be a non-negative duration, eg; 30s", http.StatusBadRequest)
+			return
+		}
+		if wait > e.maxWait {
+			wait = e.maxWait
+		}
+	}
 	//look up hash
-	hash, err := e.store.Load(&u)
+	var hash []byte
+	if wait > 0 && !e.cancelled.Has(&u) {
+		hash, err = e.waitForHash(req, &u, wait)
+	} else {
+		hash, err = e.store.Load(&u)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
+	} else if hash == nil && e.cancelled.Has(&u) {
+		http.Error(w, fmt.Sprintf("job id %s was cancelled", strid), http.StatusGone)
+		return
 	} else if hash == nil {
 		r := fmt.Sprintf("hash for job id %s not found", strid)
 		http.Error(w, r, http.StatusNotFound)
@@ -253,10 +873,48 @@ func (e *APIEngine) onHashGet(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, base64hash)
 }
 
+//Blocks the handler goroutine until a hash is stored for id, wait elapses or the request is cancelled
+//
+//Returns a nil slice if the hash didn't become available in time.
+//Waiters only hold a buffered channel in the store's watch list, so no extra goroutines are spawned
+func (e *APIEngine) waitForHash(req *http.Request, id *jumphasher.UUID, wait time.Duration) ([]byte, error) {
+	c, err := e.store.Watch(id)
+	if err != nil {
+		return nil, err
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case r := <-c:
+		return r.Hash, r.Err
+	case <-t.C:
+	case <-req.Context().Done():
+	case <-e.stopping:
+	}
+	e.store.Unwatch(id, c)
+	return nil, nil
+}
+
+//Snapshot of request metrics along with queue, scheduler and worker pool state
+func (e *APIEngine) stats() *MSMetrics {
+	snap := e.metrics.MSSnapshot()
+	snap.Backlog = uint64(e.scheduler.Len())
+	snap.Queued = uint64(e.queueDepth())
+	snap.Shed = uint64(atomic.LoadInt64(&e.shed))
+	snap.Workers = uint64(atomic.LoadInt64(&e.pool.workers))
+	snap.ScaleEvents = uint64(atomic.LoadInt64(&e.pool.scaleEvents))
+	snap.Classes = e.classMetrics()
+	snap.Limiter = e.limiter.Metrics()
+	snap.Certs = e.certMetrics()
+	return snap
+}
+
 //route handler for GET /stats
+//
+//Rate limiter state is limited to the caller's own tenant. POST /admin/stats has the full view
 func (e *APIEngine) onStatsGet(w http.ResponseWriter, req *http.Request) {
-	//fetch metrics snapshot
-	snap := e.metrics.MSSnapshot()
+	snap := e.stats()
+	snap.Limiter = e.limiter.TenantMetrics(requestTenant(req))
 	j, err := snap.MarshalJson()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -267,18 +925,3 @@ func (e *APIEngine) onStatsGet(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(j)))
 	w.Write(j)
 }
-
-//route handler for GET /shutdown
-func (e *APIEngine) onShutdownGet(w http.ResponseWriter, req *http.Request) {
-	if !e.alive.Test() {
-		http.Error(w, "server already shutting down", http.StatusBadRequest)
-		return
-	}
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	r := "commencing shutdown"
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(r)))
-	io.WriteString(w, r)
-	log.Println("Received shutdown request. Commencing shutdown")
-	go e.Stop()
-}
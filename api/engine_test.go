@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/iamthebot/jumphasher/common"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestEngine(t *testing.T, cfg EngineConfig) *APIEngine {
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = 2
+	}
+	e, err := NewAPIEngine(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestAPIEngine_onHashGetWait(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{MaxWait: 2 * time.Second})
+	u, _ := jumphasher.UUIDv4()
+
+	//hash becomes available while we're waiting
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		e.store.Store(u, []byte("hash"))
+	}()
+	start := time.Now()
+	w := httptest.NewRecorder()
+	e.onHashGet(w, httptest.NewRequest("GET", "/hash?wait=10s&id="+u.MarshalText(), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status: %d Actual: %d", http.StatusOK, w.Code)
+	}
+	if w.Body.String() != base64.StdEncoding.EncodeToString([]byte("hash")) {
+		t.Errorf("Unexpected body: %s", w.Body.String())
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Waiter should return as soon as the hash is stored")
+	}
+
+	//hash never shows up. Wait is capped at MaxWait
+	u2, _ := jumphasher.UUIDv4()
+	start = time.Now()
+	w = httptest.NewRecorder()
+	e.onHashGet(w, httptest.NewRequest("GET", "/hash?wait=1h&id="+u2.MarshalText(), nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusNotFound, w.Code)
+	}
+	if elapsed := time.Since(start); elapsed < 2*time.Second || elapsed > 3*time.Second {
+		t.Errorf("Expected wait to be capped at 2s, waited %s", elapsed)
+	}
+
+	//malformed waits are rejected
+	w = httptest.NewRecorder()
+	e.onHashGet(w, httptest.NewRequest("GET", "/hash?wait=soon&id="+u2.MarshalText(), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestAPIEngine_requestDelay(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{Delay: 5 * time.Second, MinDelay: time.Second, MaxDelay: time.Hour})
+	cases := []struct {
+		query string
+		delay time.Duration
+		ok    bool
+	}{
+		{"", 5 * time.Second, true},
+		{"delay=10", 10 * time.Second, true},
+		{"delay=1500ms", 1500 * time.Millisecond, true},
+		{"delay=0", 0, false},
+		{"delay=2h", 0, false},
+		{"delay=soon", 0, false},
+		{"available_at=" + time.Now().Add(30*time.Minute).UTC().Format(time.RFC3339), 30 * time.Minute, true},
+		{"available_at=" + time.Now().Add(2*time.Hour).UTC().Format(time.RFC3339), 0, false},
+		{"available_at=tomorrow", 0, false},
+		{"delay=10&available_at=" + time.Now().UTC().Format(time.RFC3339), 0, false},
+	}
+	for _, c := range cases {
+		d, _, err := e.requestDelay(httptest.NewRequest("POST", "/hash?"+c.query, nil))
+		if (err == nil) != c.ok {
+			t.Errorf("%s: Expected ok: %t Error: %v", c.query, c.ok, err)
+			continue
+		}
+		//available_at is relative to now, so allow a little slack
+		if c.ok && (d > c.delay || d < c.delay-2*time.Second) {
+			t.Errorf("%s: Expected delay: %s Actual: %s", c.query, c.delay, d)
+		}
+	}
+
+	if _, err := NewAPIEngine(EngineConfig{Concurrency: 1, Delay: time.Minute, MaxDelay: time.Second}); err == nil {
+		t.Error("Expected default delay above the maximum to be rejected")
+	}
+}
+
+//With a zero delay the hash must be retrievable as soon as POST /hash returns
+func TestAPIEngine_onHashPostZeroDelay(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{Delay: time.Minute})
+	e.alive.TestAndSet()
+	e.startWorkers()
+
+	w := httptest.NewRecorder()
+	e.onHashPost(w, httptest.NewRequest("POST", "/hash?delay=0", strings.NewReader("hunter2")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status: %d Actual: %d (%s)", http.StatusOK, w.Code, w.Body.String())
+	}
+	w2 := httptest.NewRecorder()
+	e.onHashGet(w2, httptest.NewRequest("GET", "/hash?id="+w.Body.String(), nil))
+	if w2.Code != http.StatusOK {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusOK, w2.Code)
+	}
+
+	//the default delay still applies otherwise
+	w = httptest.NewRecorder()
+	e.onHashPost(w, httptest.NewRequest("POST", "/hash", strings.NewReader("hunter2")))
+	w2 = httptest.NewRecorder()
+	e.onHashGet(w2, httptest.NewRequest("GET", "/hash?id="+w.Body.String(), nil))
+	if w2.Code != http.StatusNotFound {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusNotFound, w2.Code)
+	}
+}
+
+func TestAPIEngine_onHashPostSync(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{Delay: time.Minute})
+	e.alive.TestAndSet()
+	e.startWorkers()
+	expected, _ := jumphasher.NewSHA512Engine().Hash([]byte("hunter2"))
+
+	for _, target := range []string{"/hash?sync=true", "/hash/sync"} {
+		w := httptest.NewRecorder()
+		e.onHashPost(w, httptest.NewRequest("POST", target, strings.NewReader("hunter2")))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: Expected status: %d Actual: %d (%s)", target, http.StatusOK, w.Code, w.Body.String())
+		}
+		if w.Body.String() != base64.StdEncoding.EncodeToString(expected) {
+			t.Errorf("%s: Unexpected hash: %s", target, w.Body.String())
+		}
+		if w.Header().Get("X-Job-ID") != "" {
+			t.Errorf("%s: Job ID returned although nothing was stored", target)
+		}
+	}
+	if snap := e.metrics.MSSnapshot(); snap.Total != 2 {
+		t.Errorf("Expected requests: %d Actual: %d", 2, snap.Total)
+	}
+
+	//store=true records the hash under the returned job ID
+	w := httptest.NewRecorder()
+	e.onHashPost(w, httptest.NewRequest("POST", "/hash?sync=true&store=true", strings.NewReader("hunter2")))
+	var u jumphasher.UUID
+	if err := u.UnmarshalText(w.Header().Get("X-Job-ID")); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := e.store.Load(&u); base64.StdEncoding.EncodeToString(h) != w.Body.String() {
+		t.Error("Synchronous hash with store=true was not recorded")
+	}
+
+	w = httptest.NewRecorder()
+	e.onHashPost(w, httptest.NewRequest("POST", "/hash/sync?delay=5", strings.NewReader("hunter2")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+//With every worker queue full, requests are shed with a 429 once the enqueue timeout elapses
+func TestAPIEngine_onHashPostShed(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{Concurrency: 1, QueueSize: 1, EnqueueTimeout: 10 * time.Millisecond})
+	e.alive.TestAndSet()
+	//no workers, so nothing drains the queue
+	e.queues[PriorityNormal] <- &HashingRequest{}
+
+	w := httptest.NewRecorder()
+	e.onHashPost(w, httptest.NewRequest("POST", "/hash", strings.NewReader("hunter2")))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status: %d Actual: %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Shed request is missing Retry-After")
+	}
+
+	w = httptest.NewRecorder()
+	e.onStatsGet(w, httptest.NewRequest("GET", "/stats", nil))
+	var snap MSMetrics
+	if err := json.Unmarshal(w.Body.Bytes(), &snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.Queued != 1 || snap.Shed != 1 {
+		t.Errorf("Expected queued: 1 shed: 1 Actual: queued: %d shed: %d", snap.Queued, snap.Shed)
+	}
+}
+
+//Skewed workload for the dispatch benchmarks: every benchmarkSlowEvery'th request takes far longer than the rest.
+//Service times are simulated with sleeps so the comparison measures routing, not how many cores the box has
+const (
+	benchmarkWorkers   = 4
+	benchmarkClients   = 32
+	benchmarkSlowEvery = 200
+	benchmarkFastCost  = 100 * time.Microsecond
+	benchmarkSlowCost  = 20 * time.Millisecond
+)
+
+//Simulated worker
+func benchmarkWorker(c chan *HashingRequest) {
+	for r := range c {
+		time.Sleep(time.Duration(binary.LittleEndian.Uint64(r.Password)))
+		r.ReturnChan <- nil
+	}
+}
+
+//Runs b.N requests through dispatch from concurrent clients and reports latency percentiles for the fast requests,
+//which are the ones held up when a slow one hogs their worker
+func benchmarkDispatch(b *testing.B, dispatch func(r *HashingRequest)) {
+	latencies := make([]time.Duration, 0, b.N)
+	var lock sync.Mutex
+	var next int64 = -1
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for c := 0; c < benchmarkClients; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := atomic.AddInt64(&next, 1)
+				if i >= int64(b.N) {
+					return
+				}
+				id, _ := jumphasher.UUIDv4()
+				r := &HashingRequest{ID: *id, Password: make([]byte, 8), ReturnChan: make(chan error)}
+				cost := benchmarkFastCost
+				if i%benchmarkSlowEvery == 0 {
+					cost = benchmarkSlowCost
+				}
+				binary.LittleEndian.PutUint64(r.Password, uint64(cost))
+				start := time.Now()
+				dispatch(r)
+				<-r.ReturnChan
+				if cost == benchmarkFastCost {
+					lock.Lock()
+					latencies = append(latencies, time.Since(start))
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	b.ReportMetric(float64(latencies[len(latencies)/2].Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+	b.ReportMetric(float64(latencies[len(latencies)*999/1000].Nanoseconds()), "p999-ns")
+}
+
+//Workers share a single queue, as submit does
+func BenchmarkDispatchShared(b *testing.B) {
+	queue := make(chan *HashingRequest, benchmarkClients)
+	for i := 0; i < benchmarkWorkers; i++ {
+		go benchmarkWorker(queue)
+	}
+	benchmarkDispatch(b, func(r *HashingRequest) { queue <- r })
+	close(queue)
+}
+
+//The approach the shared queue replaced: requests pinned to a worker by job ID
+func BenchmarkDispatchPinned(b *testing.B) {
+	chans := make([]chan *HashingRequest, benchmarkWorkers)
+	for i := range chans {
+		chans[i] = make(chan *HashingRequest, benchmarkClients/benchmarkWorkers)
+		go benchmarkWorker(chans[i])
+	}
+	benchmarkDispatch(b, func(r *HashingRequest) {
+		chans[binary.LittleEndian.Uint32(r.ID[0:4])%uint32(len(chans))] <- r
+	})
+	for _, c := range chans {
+		close(c)
+	}
+}
+
+//Without a journal, Stop must persist delayed jobs straight away rather than wait out their delay
+func TestAPIEngine_StopFlushesDelayedJobs(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{Delay: time.Hour, MaxDelay: 2 * time.Hour})
+	e.alive.TestAndSet()
+	e.startWorkers()
+	w := httptest.NewRecorder()
+	e.onHashPost(w, httptest.NewRequest("POST", "/hash", strings.NewReader("hunter2")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status: %d Actual: %d (%s)", http.StatusOK, w.Code, w.Body.String())
+	}
+	var u jumphasher.UUID
+	if err := u.UnmarshalText(w.Body.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		e.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waited for the delayed job to come due")
+	}
+	if h, _ := e.store.Load(&u); h == nil {
+		t.Error("Delayed job was not persisted by Stop")
+	}
+}
+
+//Stop drains listeners, ends long polls, leaves delayed jobs in the journal and returns rather than exiting
+func TestAPIEngine_StartStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jumphasher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.journal")
+	e := newTestEngine(t, EngineConfig{Delay: time.Minute, JournalPath: path, DrainTimeout: time.Second})
+	started := make(chan error)
+	go func() { started <- e.Start() }()
+	for !e.alive.Test() {
+		time.Sleep(time.Millisecond)
+	}
+
+	//a delayed job and a long poll on it
+	w := httptest.NewRecorder()
+	e.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/hash", strings.NewReader("hunter2")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status: %d Actual: %d (%s)", http.StatusOK, w.Code, w.Body.String())
+	}
+	strid := w.Body.String()
+	polled := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		e.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/hash?id="+strid+"&wait=60s", nil))
+		polled <- w.Code
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		e.Stop()
+		close(stopped)
+	}()
+	select {
+	case code := <-polled:
+		if code != http.StatusNotFound {
+			t.Errorf("Expected status: %d Actual: %d", http.StatusNotFound, code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Long poll was not ended by shutdown")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+	if err := <-started; err != nil {
+		t.Errorf("Start returned %v after a graceful shutdown", err)
+	}
+	e.Stop() //harmless the second time
+
+	w = httptest.NewRecorder()
+	e.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/hash", strings.NewReader("hunter2")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if err := e.submit(&HashingRequest{}); err != ErrShuttingDown {
+		t.Errorf("Expected: %v Actual: %v", ErrShuttingDown, err)
+	}
+	j, pending, err := OpenJobJournal(path, nil, testTenantSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if len(pending) != 1 || pending[0].ID.MarshalText() != strid {
+		t.Errorf("Delayed job was not left in the journal: %v", pending)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/iamthebot/jumphasher/common"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Job states reported on GET /events
+const (
+	JobStateAccepted  = "accepted"  //hashed and waiting out the delay
+	JobStateCompleted = "completed" //hash is available via GET /hash
+	JobStateCancelled = "cancelled" //cancelled via POST /jobs/{id}/cancel before the hash was stored
+)
+
+//Default number of events kept around for Last-Event-ID resume
+const DefaultEventBuffer = 4096
+
+//How often idle event streams get a heartbeat comment so proxies don't time them out
+const eventHeartbeat = 15 * time.Second
+
+//Events buffered per subscriber before it's considered too slow and disconnected
+const subscriberBuffer = 256
+
+//A job state transition
+type JobEvent struct {
+	Seq         uint64          `json:"-"` //sent as the SSE event ID
+	ID          jumphasher.UUID `json:"-"`
+	StrID       string          `json:"id"`
+	State       string          `json:"state"`
+	CompletedAt *time.Time      `json:"completed_at"`
+	tenant      string          //only streamed to clients of this tenant
+}
+
+//An event stream consumer
+//
+//If the consumer falls more than subscriberBuffer events behind, c is closed and the consumer
+//is expected to reconnect with Last-Event-ID
+type eventSubscriber struct {
+	c chan *JobEvent
+}
+
+//Fans job events out to subscribers and keeps a bounded ring buffer of recent events for resume
+//
+//Publishing never blocks on subscribers
+type EventBus struct {
+	ring []*JobEvent
+	seq  uint64 //sequence number of the most recently published event
+	subs map[*eventSubscriber]struct{}
+	lock sync.Mutex
+}
+
+//Creates a new EventBus remembering the last size events
+func NewEventBus(size int) *EventBus {
+	var b EventBus
+	b.ring = make([]*JobEvent, size)
+	b.subs = make(map[*eventSubscriber]struct{})
+	return &b
+}
+
+//Publish a state transition for a job
+//
+//id is the job ID as stored. Subscribers see it as t sees it
+func (b *EventBus) Publish(t *Tenant, id *jumphasher.UUID, state string) {
+	ev := &JobEvent{ID: t.ClientID(id), State: state, tenant: tenantName(t)}
+	ev.StrID = ev.ID.MarshalText()
+	if state == JobStateCompleted {
+		now := time.Now().UTC()
+		ev.CompletedAt = &now
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.seq++
+	ev.Seq = b.seq
+	if len(b.ring) > 0 {
+		b.ring[ev.Seq%uint64(len(b.ring))] = ev
+	}
+	for s := range b.subs {
+		select {
+		case s.c <- ev:
+		default: //too slow. Cut it loose rather than block publishers
+			close(s.c)
+			delete(b.subs, s)
+		}
+	}
+}
+
+//Registers a new subscriber
+//
+//If resume is true, every buffered event after lastSeq is returned as a backlog to send before anything
+//received on the subscriber's channel. Events older than the ring buffer are lost
+func (b *EventBus) Subscribe(lastSeq uint64, resume bool) (*eventSubscriber, []*JobEvent) {
+	s := &eventSubscriber{c: make(chan *JobEvent, subscriberBuffer)}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var backlog []*JobEvent
+	if resume && lastSeq < b.seq {
+		first := lastSeq + 1
+		if n := uint64(len(b.ring)); b.seq-lastSeq > n {
+			first = b.seq - n + 1
+		}
+		for seq := first; seq <= b.seq; seq++ {
+			backlog = append(backlog, b.ring[seq%uint64(len(b.ring))])
+		}
+	}
+	b.subs[s] = struct{}{}
+	return s, backlog
+}
+
+//Unregisters a subscriber
+func (b *EventBus) Unsubscribe(s *eventSubscriber) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, exists := b.subs[s]; exists {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
+
+//Writes a single event in SSE framing
+func writeEvent(w http.ResponseWriter, ev *JobEvent) error {
+	j, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: job\ndata: %s\n\n", ev.Seq, j)
+	return err
+}
+
+//route handler for GET /events
+//
+//Streams job state transitions as Server-Sent Events for the comma separated job IDs in the required 'ids'
+//parameter. Job IDs are what grants access to hashes, so a stream never reveals IDs the client didn't already
+//know. Clients resume by sending the Last-Event-ID header (or 'last_event_id' parameter)
+func (e *APIEngine) onEventsGet(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	var filter map[jumphasher.UUID]struct{}
+	for _, param := range req.URL.Query()["ids"] {
+		for _, strid := range strings.Split(param, ",") {
+			if strid == "" {
+				continue
+			}
+			var u jumphasher.UUID
+			if err := u.UnmarshalText(strid); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if filter == nil {
+				filter = make(map[jumphasher.UUID]struct{})
+			}
+			filter[u] = struct{}{}
+		}
+	}
+	if filter == nil {
+		http.Error(w, "ids must list the job IDs to stream events for", http.StatusBadRequest)
+		return
+	}
+	var lastSeq uint64
+	resume := false
+	strlast := req.Header.Get("Last-Event-ID")
+	if strlast == "" {
+		strlast = req.URL.Query().Get("last_event_id")
+	}
+	if strlast != "" {
+		var err error
+		lastSeq, err = strconv.ParseUint(strlast, 10, 64)
+		if err != nil {
+			http.Error(w, "Last-Event-ID must be an event ID previously sent by this server", http.StatusBadRequest)
+			return
+		}
+		resume = true
+	}
+
+	sub, backlog := e.events.Subscribe(lastSeq, resume)
+	defer e.events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	tenant := tenantName(requestTenant(req))
+	send := func(ev *JobEvent) error {
+		if ev.tenant != tenant {
+			return nil
+		}
+		if _, exists := filter[ev.ID]; !exists {
+			return nil
+		}
+		return writeEvent(w, ev)
+	}
+	for _, ev := range backlog {
+		if err := send(ev); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(e.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.c:
+			if !ok { //we fell behind. The client will reconnect with Last-Event-ID
+				return
+			}
+			if err := send(ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		case <-e.stopping: //the client will reconnect with Last-Event-ID once we're back
+			return
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/iamthebot/jumphasher/common"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBus_Subscribe(t *testing.T) {
+	b := NewEventBus(4)
+	ids := make([]jumphasher.UUID, 6)
+	for i := range ids {
+		u, _ := jumphasher.UUIDv4()
+		ids[i] = *u
+		b.Publish(nil, u, JobStateAccepted)
+	}
+
+	//resume from event 3. Events 4-6 are still buffered
+	s, backlog := b.Subscribe(3, true)
+	if len(backlog) != 3 {
+		t.Fatalf("Expected backlog: %d Actual: %d", 3, len(backlog))
+	}
+	for i, ev := range backlog {
+		if ev.Seq != uint64(4+i) || !ev.ID.Equals(&ids[3+i]) {
+			t.Errorf("Unexpected backlog event %d: %+v", i, ev)
+		}
+	}
+	b.Unsubscribe(s)
+
+	//resume from before the ring buffer. We get whatever's left
+	s, backlog = b.Subscribe(0, true)
+	if len(backlog) != 4 || backlog[0].Seq != 3 {
+		t.Errorf("Expected 4 events starting at 3, got %d", len(backlog))
+	}
+
+	//live events are delivered on the channel
+	b.Publish(nil, &ids[0], JobStateCompleted)
+	ev := <-s.c
+	if ev.State != JobStateCompleted || ev.CompletedAt == nil {
+		t.Errorf("Unexpected live event: %+v", ev)
+	}
+
+	//slow subscribers are disconnected rather than blocking publishers
+	for i := 0; i < subscriberBuffer+1; i++ {
+		b.Publish(nil, &ids[0], JobStateAccepted)
+	}
+	for range s.c {
+	}
+	b.Unsubscribe(s) //must be safe after a disconnect
+}
+
+func TestAPIEngine_onEventsGet(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{})
+	e.heartbeat = 50 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(e.onEventsGet))
+	defer srv.Close()
+
+	wanted, _ := jumphasher.UUIDv4()
+	other, _ := jumphasher.UUIDv4()
+	e.events.Publish(nil, wanted, JobStateAccepted)
+
+	//streaming every job would hand out everyone's job IDs
+	if resp, err := http.Get(srv.URL); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d without ids, got %v %v", http.StatusBadRequest, resp, err)
+	}
+
+	//resume from the start, filtered to a single job
+	req, _ := http.NewRequest("GET", srv.URL+"?ids="+wanted.MarshalText(), nil)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected Content-Type: %s Actual: %s", "text/event-stream", ct)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond) //long enough for a heartbeat
+		e.events.Publish(nil, other, JobStateCompleted)
+		e.events.Publish(nil, wanted, JobStateCompleted)
+	}()
+
+	r := bufio.NewReader(resp.Body)
+	var states []string
+	heartbeats := 0
+	for len(states) < 2 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, ": heartbeat") {
+			heartbeats++
+		}
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var ev JobEvent
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.StrID != wanted.MarshalText() {
+			t.Errorf("Received event for unfiltered job %s", ev.StrID)
+		}
+		states = append(states, ev.State)
+	}
+	if states[0] != JobStateAccepted || states[1] != JobStateCompleted {
+		t.Errorf("Unexpected states: %v", states)
+	}
+	if heartbeats == 0 {
+		t.Error("Expected at least one heartbeat")
+	}
+}
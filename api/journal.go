@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/iamthebot/jumphasher/common"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+//Journal record tags
+const (
+	journalTagAdd       byte = 'A' //job accepted: ID, due time, hash, callback URL
+	journalTagAddTenant byte = 'T' //job accepted on behalf of a tenant: as journalTagAdd, followed by the tenant name
+	journalTagAddSealed byte = 'S' //as journalTagAddTenant, but the hash is sealed with the keyring and the tenant name may be empty
+	journalTagDone      byte = 'D' //job persisted (or dropped): ID
+)
+
+//Once this many completed jobs have accumulated (and they outnumber pending ones 2:1) the journal is compacted
+const journalCompactThreshold = 100000
+
+//Longest hash or callback URL we'll accept when replaying, so corrupt lengths can't exhaust memory
+const maxJournalField = 1 << 20
+
+var ErrJournalClosed error = errors.New("job journal is closed")
+
+var ErrCorruptJournal error = errors.New("job journal is corrupt before its last record")
+
+var ErrJournalSealed error = errors.New("job journal holds sealed hashes, so it can only be opened with the keyfile")
+
+//Write-ahead journal of accepted jobs that haven't been persisted yet
+//
+//Jobs are appended and fsynced before the client gets its job ID, and marked done once their hash is stored.
+//On startup the journal is replayed so jobs accepted before a crash or restart still get persisted.
+//A torn record at the tail is discarded, anything else unreadable fails the open, and the file is rewritten with only pending jobs on open and
+//whenever completed records pile up
+//
+//With a keyring, hashes are sealed just as the encrypted hash store seals them, so they're never on disk in the clear.
+//Records written without one are sealed when the journal is next compacted
+type JobJournal struct {
+	path    string
+	f       *os.File
+	keys    *jumphasher.Keyring //if nil, hashes are journaled as they are
+	secret  []byte              //tenant secret, for rebuilding replayed jobs' tenants
+	pending map[jumphasher.UUID]*ScheduledJob
+	done    int //done records in the file since the last compaction
+	lock    sync.Mutex
+}
+
+//Opens (or creates) the journal at path, returning it along with every job that was still pending
+//
+//keys: If not nil, hashes are sealed with it before they're written
+//
+//tenantSecret: Server secret job IDs were mapped under. See NewTenant
+func OpenJobJournal(path string, keys *jumphasher.Keyring, tenantSecret []byte) (*JobJournal, []*ScheduledJob, error) {
+	var j JobJournal
+	j.path = path
+	j.keys = keys
+	j.secret = tenantSecret
+	j.pending = make(map[jumphasher.UUID]*ScheduledJob)
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = j.replay(f)
+	f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := j.compact(); err != nil {
+		return nil, nil, err
+	}
+	jobs := make([]*ScheduledJob, 0, len(j.pending))
+	for _, job := range j.pending {
+		jobs = append(jobs, job)
+	}
+	return &j, jobs, nil
+}
+
+//Replays the journal into pending
+//
+//Only a record cut short by the end of the file is treated as torn. Since the journal is compacted straight after,
+//anything else must fail rather than drop the jobs recorded after it
+func (j *JobJournal) replay(f *os.File) error {
+	r := bufio.NewReader(f)
+	for {
+		tag, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var id jumphasher.UUID
+		if _, err := io.ReadFull(r, id[:]); err != nil {
+			return tornJournal(err)
+		}
+		switch tag {
+		case journalTagAdd, journalTagAddTenant, journalTagAddSealed:
+			job := &ScheduledJob{ID: id}
+			var due [8]byte
+			if _, err := io.ReadFull(r, due[:]); err != nil {
+				return tornJournal(err)
+			}
+			job.Due = time.Unix(0, int64(binary.LittleEndian.Uint64(due[:])))
+			if job.Hash, err = readJournalField(r); err != nil {
+				return tornJournal(err)
+			}
+			cb, err := readJournalField(r)
+			if err != nil {
+				return tornJournal(err)
+			}
+			job.CallbackURL = string(cb)
+			if tag == journalTagAddTenant || tag == journalTagAddSealed {
+				name, err := readJournalField(r)
+				if err != nil {
+					return tornJournal(err)
+				}
+				if tag == journalTagAddTenant || len(name) > 0 {
+					job.Tenant = NewTenant(string(name), PriorityNormal, j.secret)
+				}
+			}
+			if tag == journalTagAddSealed {
+				//a complete record we can't open must not be mistaken for a torn tail, or compaction would drop it
+				if j.keys == nil {
+					return ErrJournalSealed
+				}
+				if job.Hash, _, err = j.keys.Open(job.Hash, id[:]); err != nil {
+					return fmt.Errorf("could not open hash for job %s: %s", id.MarshalText(), err.Error())
+				}
+			}
+			j.pending[id] = job
+		case journalTagDone:
+			delete(j.pending, id)
+		default: //we never write any other tag, so this isn't a torn write
+			return ErrCorruptJournal
+		}
+	}
+}
+
+//Error replaying a record that failed with err. Running out of file means the record is a torn tail, which is dropped
+func tornJournal(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
+
+func readJournalField(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, err
+	} else if err != nil {
+		return nil, ErrCorruptJournal //overlong varint
+	}
+	if n > maxJournalField {
+		return nil, ErrCorruptJournal
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+func (j *JobJournal) encodeAdd(buf []byte, job *ScheduledJob) ([]byte, error) {
+	var tmp [binary.MaxVarintLen64]byte
+	tag := journalTagAdd
+	if job.Tenant != nil {
+		tag = journalTagAddTenant
+	}
+	h := job.Hash
+	if j.keys != nil {
+		tag = journalTagAddSealed
+		var err error
+		if h, err = j.keys.Seal(job.Hash, job.ID[:]); err != nil {
+			return nil, err
+		}
+	}
+	buf = append(buf, tag)
+	buf = append(buf, job.ID[:]...)
+	binary.LittleEndian.PutUint64(tmp[:8], uint64(job.Due.UnixNano()))
+	buf = append(buf, tmp[:8]...)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(h)))]...)
+	buf = append(buf, h...)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(job.CallbackURL)))]...)
+	buf = append(buf, job.CallbackURL...)
+	if tag != journalTagAdd {
+		name := tenantName(job.Tenant)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(name)))]...)
+		buf = append(buf, name...)
+	}
+	return buf, nil
+}
+
+//Rewrites the journal with only pending jobs. Must be called with lock held (or before the journal is shared)
+func (j *JobJournal) compact() error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var buf []byte
+	for _, job := range j.pending {
+		if buf, err = j.encodeAdd(buf[:0], job); err != nil {
+			break
+		}
+		w.Write(buf)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	j.done = 0
+	return err
+}
+
+//Durably records an accepted job. Returns once the record has been fsynced
+func (j *JobJournal) Append(job *ScheduledJob) error {
+	rec, err := j.encodeAdd(nil, job)
+	if err != nil {
+		return err
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.f == nil {
+		return ErrJournalClosed
+	}
+	if _, err := j.f.Write(rec); err != nil {
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	j.pending[job.ID] = job
+	return nil
+}
+
+//Durably marks jobs as finished so they aren't replayed
+func (j *JobJournal) Done(ids ...*jumphasher.UUID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	rec := make([]byte, 0, len(ids)*17)
+	for _, id := range ids {
+		rec = append(rec, journalTagDone)
+		rec = append(rec, id[:]...)
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.f == nil {
+		return ErrJournalClosed
+	}
+	if _, err := j.f.Write(rec); err != nil {
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		delete(j.pending, *id)
+	}
+	j.done += len(ids)
+	if j.done >= journalCompactThreshold && j.done > 2*len(j.pending) {
+		return j.compact()
+	}
+	return nil
+}
+
+//Number of jobs recorded but not yet done
+func (j *JobJournal) Len() int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return len(j.pending)
+}
+
+//Closes the journal. Pending jobs stay on disk and are replayed on the next open
+func (j *JobJournal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
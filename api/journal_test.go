@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/iamthebot/jumphasher/common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJobJournal_Replay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jumphasher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.journal")
+
+	j, pending, err := OpenJobJournal(path, nil, testTenantSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Expected pending: %d Actual: %d", 0, len(pending))
+	}
+	due := time.Now().Add(time.Minute).Round(0)
+	jobs := make([]*ScheduledJob, 10)
+	for i := range jobs {
+		u, _ := jumphasher.UUIDv4()
+		jobs[i] = &ScheduledJob{ID: *u, Hash: u[:], Due: due}
+		if i == 0 {
+			jobs[i].CallbackURL = "https://example.com/done"
+		}
+		if i == 1 {
+			jobs[i].Tenant = NewTenant("team-a", PriorityNormal, testTenantSecret)
+		}
+		if err := j.Append(jobs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//finish the last half
+	for _, job := range jobs[5:] {
+		if err := j.Done(&job.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//simulate a crash rather than a clean close, and a torn record on the tail
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{journalTagAdd, 1, 2, 3})
+	f.Close()
+
+	j2, pending, err := OpenJobJournal(path, nil, testTenantSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j2.Close()
+	if len(pending) != 5 {
+		t.Fatalf("Expected pending: %d Actual: %d", 5, len(pending))
+	}
+	byID := make(map[jumphasher.UUID]*ScheduledJob)
+	for _, job := range pending {
+		byID[job.ID] = job
+	}
+	for _, job := range jobs[:5] {
+		r, exists := byID[job.ID]
+		if !exists {
+			t.Errorf("Job %s lost across restart", job.ID.MarshalText())
+			continue
+		}
+		if !r.Due.Equal(job.Due) || string(r.Hash) != string(job.Hash) || r.CallbackURL != job.CallbackURL || tenantName(r.Tenant) != tenantName(job.Tenant) {
+			t.Errorf("Job %s replayed incorrectly: %+v", job.ID.MarshalText(), r)
+		}
+	}
+	j.Close()
+}
+
+//Only a torn tail is dropped. Corruption before it fails the open and leaves the journal as it was
+func TestJobJournal_Corrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jumphasher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.journal")
+	for _, c := range []struct {
+		name    string
+		at      int64
+		garbage []byte
+	}{
+		{"unknown tag", 0, []byte{'X'}},
+		{"oversized field", 25, []byte{0xff, 0xff, 0xff, 0x7f}},
+	} {
+		os.Remove(path)
+		j, _, err := OpenJobJournal(path, nil, testTenantSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			u, _ := jumphasher.UUIDv4()
+			j.Append(&ScheduledJob{ID: *u, Hash: u[:], Due: time.Now().Add(time.Minute)})
+		}
+		j.Close()
+		f, _ := os.OpenFile(path, os.O_WRONLY, 0600)
+		f.WriteAt(c.garbage, c.at)
+		f.Close()
+		before, _ := ioutil.ReadFile(path)
+		if _, _, err := OpenJobJournal(path, nil, testTenantSecret); err != ErrCorruptJournal {
+			t.Errorf("%s: Expected: %v Actual: %v", c.name, ErrCorruptJournal, err)
+		}
+		if after, _ := ioutil.ReadFile(path); !bytes.Equal(before, after) {
+			t.Errorf("%s: Corrupt journal was compacted", c.name)
+		}
+	}
+}
+
+//Jobs acknowledged by an engine must be persisted by the next engine using the same journal
+func TestAPIEngine_JournalRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jumphasher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.journal")
+	j, _, err := OpenJobJournal(path, nil, testTenantSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := jumphasher.UUIDv4()
+	//already due, and accepted by a run that had webhooks enabled
+	j.Append(&ScheduledJob{ID: *u, Hash: []byte("hash"), Due: time.Now().Add(-time.Second), CallbackURL: "https://example.com/done"})
+	j.Close()
+
+	e := newTestEngine(t, EngineConfig{JournalPath: path})
+	time.Sleep(20 * time.Millisecond)
+	if h, _ := e.store.Load(u); h != nil {
+		t.Error("Recovered job was persisted before the engine started")
+	}
+	c, _ := e.store.Watch(u)
+	e.scheduler.Start()
+	select {
+	case r := <-c:
+		if string(r.Hash) != "hash" {
+			t.Errorf("Expected: %s Actual: %s", "hash", r.Hash)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Recovered job was never persisted")
+	}
+	e.scheduler.Close()
+	if n := e.journal.Len(); n != 0 {
+		t.Errorf("Expected pending: %d Actual: %d", 0, n)
+	}
+	e.journal.Close()
+}
+
+func TestJobJournal_Sealed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jumphasher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.journal")
+	keys := jumphasher.NewKeyring()
+	key := make([]byte, 32)
+	rand.Read(key)
+	if err := keys.AddKey(1, key); err != nil {
+		t.Fatal(err)
+	}
+
+	//a journal written in the clear is sealed once it's opened with a keyring
+	j, _, err := OpenJobJournal(path, nil, testTenantSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	due := time.Now().Add(time.Minute).Round(0)
+	u1, _ := jumphasher.UUIDv4()
+	u2, _ := jumphasher.UUIDv4()
+	j.Append(&ScheduledJob{ID: *u1, Hash: []byte("plaintext hash one"), Due: due})
+	j.Close()
+	j, _, err = OpenJobJournal(path, keys, testTenantSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Append(&ScheduledJob{ID: *u2, Hash: []byte("plaintext hash two"), Due: due, Tenant: NewTenant("team-a", PriorityNormal, testTenantSecret)})
+	j.Close()
+	raw, _ := ioutil.ReadFile(path)
+	if bytes.Contains(raw, []byte("plaintext hash")) {
+		t.Error("Hash journaled in the clear")
+	}
+
+	if _, _, err := OpenJobJournal(path, nil, testTenantSecret); err != ErrJournalSealed {
+		t.Errorf("Expected: %v Actual: %v", ErrJournalSealed, err)
+	}
+	j, pending, err := OpenJobJournal(path, keys, testTenantSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if len(pending) != 2 {
+		t.Fatalf("Expected pending: %d Actual: %d", 2, len(pending))
+	}
+	for _, job := range pending {
+		expected, tenant := "plaintext hash one", ""
+		if job.ID == *u2 {
+			expected, tenant = "plaintext hash two", "team-a"
+		}
+		if string(job.Hash) != expected || tenantName(job.Tenant) != tenant {
+			t.Errorf("Job %s replayed incorrectly: %+v", job.ID.MarshalText(), job)
+		}
+	}
+}
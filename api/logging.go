@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+)
+
+//Log levels. Each includes everything logged at the levels before it
+const (
+	LogLevelError int32 = iota //failures only
+	LogLevelInfo               //lifecycle events such as startup, shutdown, scaling and resharding
+	LogLevelDebug              //per-request detail such as shed requests and webhook retries
+)
+
+var logLevelNames = []string{"error", "info", "debug"}
+
+var ErrUnknownLogLevel error = errors.New("log level must be one of 'error', 'info' or 'debug'")
+
+//current log level. Accessed atomically so it can be changed at runtime via POST /admin/loglevel
+var logLevel int32 = LogLevelInfo
+
+//Sets the log level by name
+func SetLogLevel(name string) error {
+	for l, n := range logLevelNames {
+		if n == name {
+			atomic.StoreInt32(&logLevel, int32(l))
+			return nil
+		}
+	}
+	return ErrUnknownLogLevel
+}
+
+//Name of the current log level
+func LogLevel() string {
+	return logLevelNames[atomic.LoadInt32(&logLevel)]
+}
+
+//Logs at LogLevelInfo. Errors are always logged with log.Printf and an 'Error: ' prefix
+func infof(format string, v ...interface{}) {
+	if atomic.LoadInt32(&logLevel) >= LogLevelInfo {
+		log.Printf(format, v...)
+	}
+}
+
+//Logs at LogLevelDebug
+func debugf(format string, v ...interface{}) {
+	if atomic.LoadInt32(&logLevel) >= LogLevelDebug {
+		log.Printf(format, v...)
+	}
+}
@@ -1,18 +1,60 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"github.com/iamthebot/jumphasher/common"
+	"io/ioutil"
 	"log"
+	"net"
+	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
+	//dispatch subcommands. Anything else runs the server
+	if len(os.Args) > 1 {
+		if cmd, exists := subcommands[os.Args[1]]; exists {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
 	var sslmode string
 	var port uint
 	var delay uint
 	var sslcfg SSLConfig
 	var concurrency uint
+	var keyfile string
+	var storeSpec string
+	var maxWait time.Duration
+	var eventBuffer uint
+	var maxBacklog uint
+	var maxBatch uint
+	var queueSize uint
+	var minWorkers, maxWorkers uint
+	var enqueueTimeout time.Duration
+	var drainTimeout time.Duration
+	var journalPath string
+	var minDelay, maxDelay time.Duration
+	var webhookSecretFile string
+	var webhooks WebhookConfig
+	var webhookAllow string
+	var admin AdminConfig
+	var adminTokenFile string
+	var logLevelName string
+	var apiKeysFile string
+	var tenantSecretFile string
+	var rateLimits RateLimits
+	var clientAuth string
+	var auditLogPath string
+	var acme ACMEConfig
+	var acmeDomains string
 
 	flag.StringVar(&sslmode, "sslmode", "hybrid", "'hybrid' (serve both HTTP and HTTPS), 'exclusive' (HTTPS only), or 'disabled' (HTTP only)")
 	flag.UintVar(&port, "port", 80, "port to use for HTTP")
@@ -21,12 +63,67 @@ func main() {
 	flag.StringVar(&sslcfg.CertFile, "sslcert", "server.crt", "path to server X509 SSL certificate in PEM format. If a certificate/key pair is not found and SSL is enabled a self-signed one will be generated in this file")
 	flag.StringVar(&sslcfg.KeyFile, "sslkey", "server.pem", "path to server private key. If a certificate/key pair is not found and SSL is enabled, an elliptic key based on NIST P-256 will be generated in this file")
 	flag.UintVar(&concurrency, "concurrency", uint(runtime.NumCPU()), "target concurrency for API server and data structures")
+	flag.StringVar(&keyfile, "keyfile", "", "path to keyfile of '<key id>:<hex AES-256 key>' lines. If set, hashes are sealed with AES-256-GCM under the highest key ID before being stored")
+	flag.StringVar(&storeSpec, "store", "mem", "where to keep hashes. 'mem' (in-memory) or 'file:<path>' (durable append-only log)")
+	flag.DurationVar(&maxWait, "maxwait", DefaultMaxWait, "longest a client may block on GET /hash via the 'wait' parameter")
+	flag.UintVar(&eventBuffer, "eventbuffer", DefaultEventBuffer, "number of recent job events kept so GET /events clients can resume with Last-Event-ID")
+	flag.StringVar(&webhookSecretFile, "webhooksecret", "", "path to a file holding the HMAC-SHA256 key used to sign webhooks. If not set, POST /hash rejects callback_url")
+	flag.IntVar(&webhooks.Attempts, "webhookattempts", DefaultWebhookAttempts, "webhook delivery attempts before giving up and dead-lettering")
+	flag.IntVar(&webhooks.Concurrency, "webhookconcurrency", DefaultWebhookConcurrency, "maximum concurrent webhook requests to a single destination host")
+	flag.IntVar(&webhooks.DeadLetters, "webhookdeadletters", DefaultWebhookDeadLetters, "number of failed webhooks to remember for POST /admin/webhooks/deadletters")
+	flag.StringVar(&webhookAllow, "webhookallow", "", "comma separated CIDRs, eg; 10.1.0.0/16. Callbacks may reach these even though they're loopback, link-local or private, which is otherwise refused")
+	flag.UintVar(&maxBacklog, "maxbacklog", DefaultMaxBacklog, "maximum number of jobs waiting out their delay. Further POST /hash requests get a 503")
+	flag.UintVar(&maxBatch, "maxbatch", DefaultMaxBatch, "maximum number of passwords in a single POST /hash/batch")
+	flag.UintVar(&minWorkers, "minworkers", 0, "fewest hashing workers the pool may shrink to under light load. Defaults to concurrency")
+	flag.UintVar(&maxWorkers, "maxworkers", 0, "most hashing workers the pool may grow to under heavy load. Defaults to concurrency")
+	flag.UintVar(&queueSize, "queuesize", DefaultQueueSize, "number of hashing requests buffered per worker. queuesize × maxworkers requests are buffered in all, split evenly between the priority classes")
+	flag.DurationVar(&enqueueTimeout, "enqueuetimeout", DefaultEnqueueTimeout, "how long a hashing request may wait for room in the full worker queue before it's rejected with a 429")
+	flag.DurationVar(&drainTimeout, "draintimeout", DefaultDrainTimeout, "how long shutdown waits for in-flight requests before closing their connections")
+	flag.StringVar(&journalPath, "journal", "", "path to a durable journal of accepted jobs. If set, jobs still waiting out their delay survive restarts and crashes. Hashes in it are sealed with --keyfile if set")
+	flag.DurationVar(&minDelay, "mindelay", 0, "shortest per-request delay clients may ask for via 'delay' or 'available_at'")
+	flag.DurationVar(&maxDelay, "maxdelay", DefaultMaxDelay, "longest per-request delay clients may ask for via 'delay' or 'available_at'")
+	flag.StringVar(&admin.Addr, "adminaddr", "", "address for the admin listener, eg; 127.0.0.1:8081. If not set, admin operations are disabled")
+	flag.StringVar(&adminTokenFile, "admintoken", "", "path to a file holding the bearer token admin requests must send")
+	flag.StringVar(&admin.ClientCAFile, "adminclientca", "", "path to PEM CA certificates. If set, admin clients must present a certificate signed by one of them")
+	flag.StringVar(&admin.CertFile, "admincert", "", "path to the X509 certificate served by the admin listener. If not set, the admin listener uses plain HTTP")
+	flag.StringVar(&admin.KeyFile, "adminkey", "", "path to the private key for admincert")
+	flag.StringVar(&apiKeysFile, "apikeys", "", "path to a file of '<key>:<tenant>[:<priority>]' lines. If set, every request must carry a key and jobs are isolated per tenant. Reloaded when the file changes")
+	flag.StringVar(&tenantSecretFile, "tenantsecret", "", "path to a file holding at least 16 bytes of secret that tenants' job IDs are mapped under. Needed with apikeys or client-ca. Keep it stable, or existing jobs can't be found")
+	flag.Float64Var(&rateLimits.KeyRate, "keyrate", 0, "hashing requests per second allowed per API key. 0 means unlimited. Can be changed at runtime via POST /admin/ratelimits")
+	flag.IntVar(&rateLimits.KeyBurst, "keyburst", 0, "hashing requests an API key may make at once before keyrate applies. Defaults to keyrate rounded up")
+	flag.Float64Var(&rateLimits.IPRate, "iprate", 0, "hashing requests per second allowed per source IP. 0 means unlimited. Can be changed at runtime via POST /admin/ratelimits")
+	flag.IntVar(&rateLimits.IPBurst, "ipburst", 0, "hashing requests a source IP may make at once before iprate applies. Defaults to iprate rounded up")
+	flag.Int64Var(&rateLimits.DailyQuota, "dailyquota", 0, "hashing requests allowed per tenant per UTC day. 0 means unlimited. Needs apikeys")
+	flag.StringVar(&sslcfg.ClientCAFile, "client-ca", "", "path to PEM CA certificates. If set, HTTPS clients may present a certificate signed by one of them, whose identity selects their tenant")
+	flag.StringVar(&clientAuth, "client-auth", "require", "with client-ca, 'request' (certificates are optional) or 'require' (the handshake fails without one. Needs sslmode=exclusive)")
+	flag.StringVar(&sslcfg.ClientIdentity, "client-identity", ClientIdentitySubject, "part of a client certificate that identifies the client. 'subject' (common name) or 'san' (first URI, DNS or email subject alternative name)")
+	flag.StringVar(&auditLogPath, "auditlog", "", "path to an audit log. If set, every API and admin request is recorded with who made it as a JSON line")
+	flag.StringVar(&acme.Directory, "acme-directory", "", "directory URL of an ACME CA, eg; "+DefaultACMEDirectory+". If set, the HTTPS certificate is obtained and renewed from the CA instead of sslcert and sslkey")
+	flag.StringVar(&acmeDomains, "acme-domains", "", "comma separated names the ACME certificate must cover")
+	flag.StringVar(&acme.Email, "acme-email", "", "contact address for the ACME account")
+	flag.StringVar(&acme.CacheDir, "acme-cache", "acme", "directory the ACME account key and certificates are cached in")
+	flag.StringVar(&acme.Challenge, "acme-challenge", ACMEChallengeHTTP01, "how the CA validates our domains. '"+ACMEChallengeHTTP01+"' (on the plain HTTP port, so sslmode=hybrid) or '"+ACMEChallengeTLSALPN01+"' (on the HTTPS port)")
+	flag.BoolVar(&acme.AcceptTOS, "acme-accept-tos", false, "agree to the ACME CA's terms of service, which acme-directory needs")
+	flag.StringVar(&logLevelName, "loglevel", "info", "'error', 'info' or 'debug'. Can be changed at runtime via POST /admin/loglevel")
 	flag.Parse()
+	if err := SetLogLevel(logLevelName); err != nil {
+		log.Fatal(err)
+	}
+	if rateLimits.KeyRate < 0 || rateLimits.KeyBurst < 0 || rateLimits.IPRate < 0 || rateLimits.IPBurst < 0 || rateLimits.DailyQuota < 0 {
+		log.Fatal("Rate limits and quotas can't be negative")
+	}
 	if port > 65535 {
 		log.Fatalf("Port %d exceeds max port number 65535", port)
 	} else if sslcfg.Port > 65535 {
 		log.Fatalf("HTTPS Port %d exceeds max port number 65535", sslcfg.Port)
 	}
+	switch clientAuth {
+	case "request":
+	case "require":
+		sslcfg.RequireClientCert = sslcfg.ClientCAFile != ""
+	default:
+		log.Fatalf("Unknown client-auth '%s'", clientAuth)
+	}
 	switch sslmode {
 	case "hybrid":
 		sslcfg.Exclusive = false
@@ -37,19 +134,136 @@ func main() {
 	default:
 		log.Fatalf("Unknown sslmode '%s'", sslmode)
 	}
-	var engine *APIEngine
-	var err error
+	if sslmode == "disabled" && sslcfg.ClientCAFile != "" {
+		log.Fatal("client-ca needs sslmode=hybrid or sslmode=exclusive")
+	}
+	if acme.Directory != "" {
+		if sslmode == "disabled" {
+			log.Fatal("acme-directory needs sslmode=hybrid or sslmode=exclusive")
+		}
+		for _, d := range strings.Split(acmeDomains, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				acme.Domains = append(acme.Domains, d)
+			}
+		}
+		if len(acme.Domains) == 0 {
+			log.Fatal("acme-directory needs acme-domains")
+		}
+		if !acme.AcceptTOS {
+			log.Fatal("acme-directory needs acme-accept-tos, after reading the CA's terms of service")
+		}
+		sslcfg.ACME = &acme
+	}
+	store, err := OpenHashStore(storeSpec, int(concurrency), keyfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if webhookSecretFile != "" {
+		secret, err := ioutil.ReadFile(webhookSecretFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		webhooks.Secret = bytes.TrimSpace(secret)
+		if len(webhooks.Secret) == 0 {
+			log.Fatalf("Webhook secret file %s is empty", webhookSecretFile)
+		}
+		if webhooks.Attempts < 1 || webhooks.Concurrency < 1 {
+			log.Fatal("webhookattempts and webhookconcurrency must be at least 1")
+		}
+		for _, cidr := range strings.Split(webhookAllow, ",") {
+			if cidr = strings.TrimSpace(cidr); cidr == "" {
+				continue
+			}
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				log.Fatalf("Invalid webhookallow network '%s': %s", cidr, err.Error())
+			}
+			webhooks.Allow = append(webhooks.Allow, n)
+		}
+	}
+	cfg := EngineConfig{
+		Concurrency:    int(concurrency),
+		HashType:       jumphasher.HashTypeSHA512,
+		Port:           int(port),
+		Delay:          time.Duration(delay) * time.Second,
+		MinDelay:       minDelay,
+		MaxDelay:       maxDelay,
+		Store:          store,
+		MaxWait:        maxWait,
+		EventBuffer:    int(eventBuffer),
+		MaxBacklog:     int(maxBacklog),
+		JournalPath:    journalPath,
+		MaxBatch:       int(maxBatch),
+		MinWorkers:     int(minWorkers),
+		MaxWorkers:     int(maxWorkers),
+		QueueSize:      int(queueSize),
+		EnqueueTimeout: enqueueTimeout,
+		DrainTimeout:   drainTimeout,
+		RateLimits:     rateLimits,
+		AuditLogPath:   auditLogPath,
+	}
+	if webhooks.Secret != nil {
+		cfg.Webhooks = &webhooks
+	}
+	if admin.Addr != "" {
+		if adminTokenFile != "" {
+			token, err := ioutil.ReadFile(adminTokenFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			admin.Token = bytes.TrimSpace(token)
+			if len(admin.Token) == 0 {
+				log.Fatalf("Admin token file %s is empty", adminTokenFile)
+			}
+		}
+		cfg.Admin = &admin
+	}
+	if (apiKeysFile != "" || sslcfg.ClientCAFile != "") && tenantSecretFile == "" {
+		log.Fatal("apikeys and client-ca need tenantsecret")
+	}
+	if tenantSecretFile != "" {
+		secret, err := ioutil.ReadFile(tenantSecretFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.TenantSecret = bytes.TrimSpace(secret)
+	}
+	if apiKeysFile != "" {
+		if cfg.APIKeys, err = LoadAPIKeys(apiKeysFile, cfg.TenantSecret); err != nil {
+			log.Fatal(err)
+		}
+	}
 	if sslmode != "disabled" {
-		exists := CheckCertExists(sslcfg.KeyFile, sslcfg.CertFile)
+		exists := sslcfg.ACME != nil || CheckCertExists(sslcfg.KeyFile, sslcfg.CertFile)
 		if !exists {
 			GenSelfSignedCert(sslcfg.KeyFile, sslcfg.CertFile)
 		}
-		engine, err = NewAPIEngine(int(concurrency), jumphasher.HashTypeSHA512, &sslcfg, int(port), int(delay))
-	} else {
-		engine, err = NewAPIEngine(int(concurrency), jumphasher.HashTypeSHA512, nil, int(port), int(delay))
+		cfg.SSL = &sslcfg
 	}
+	engine, err := NewAPIEngine(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	engine.Start()
+	//reload certificates on SIGHUP
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			infof("Received SIGHUP. Reloading certificates")
+			engine.ReloadCertificates()
+		}
+	}()
+	//shut down gracefully on SIGTERM or SIGINT. A second signal exits immediately
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s. Commencing shutdown", sig)
+		go engine.Stop()
+		sig = <-signals
+		log.Fatalf("Received %s during shutdown. Exiting immediately", sig)
+	}()
+	if err := engine.Start(); err != nil {
+		log.Fatal(err)
+	}
 }
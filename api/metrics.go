@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"sync/atomic"
+	"time"
 )
 
 // Centrally keeps track of request metrics
@@ -16,8 +17,40 @@ type MetricsEngine struct {
 //
 // This is what we return from GET /stats
 type MSMetrics struct {
-	Total   uint64 `json:"total"` //number of requests so far
-	Average uint64 `json:"average"`
+	Total       uint64                   `json:"total"` //number of requests so far
+	Average     uint64                   `json:"average"`
+	Backlog     uint64                   `json:"backlog"`                //number of jobs waiting out their delay
+	Queued      uint64                   `json:"queued"`                 //number of requests waiting for a worker
+	Shed        uint64                   `json:"shed"`                   //number of requests rejected because the worker queue was full
+	Workers     uint64                   `json:"workers"`                //number of hashing workers
+	ScaleEvents uint64                   `json:"scale_events"`           //number of times the autoscaler has resized the worker pool
+	Classes     map[string]*ClassMetrics `json:"classes"`                //queue metrics per priority class
+	Limiter     *LimiterMetrics          `json:"limiter"`                //rate limits and how often they've been hit
+	Certs       map[string]*CertMetrics  `json:"certificates,omitempty"` //expiry of the certificate served by each TLS listener
+}
+
+// Queue metrics for a single priority class
+type ClassMetrics struct {
+	Queued      uint64 `json:"queued"`       //number of requests waiting for a worker
+	Served      uint64 `json:"served"`       //number of requests picked up by a worker
+	Shed        uint64 `json:"shed"`         //number of requests rejected because the class's queue was full
+	AverageWait uint64 `json:"average_wait"` //mean time served requests spent queued, in milliseconds
+}
+
+// State of a TLS listener's certificate
+type CertMetrics struct {
+	NotAfter  time.Time `json:"not_after"`            //when the certificate being served expires
+	ExpiresIn int64     `json:"expires_in"`           //seconds until then. Negative once expired
+	Reloads   uint64    `json:"reloads"`              //number of times the certificate has been loaded, including at startup
+	LastError string    `json:"last_error,omitempty"` //why the most recent reload failed, if it did
+}
+
+// Rate limiter state
+type LimiterMetrics struct {
+	Limits    RateLimits        `json:"limits"`            //limits in effect
+	Buckets   uint64            `json:"buckets,omitempty"` //number of API keys and source IPs being tracked. Only on the admin listener
+	Limited   map[string]uint64 `json:"limited,omitempty"` //number of requests rejected, by the limit that was hit: 'ip', 'key' or 'quota'. Only on the admin listener
+	QuotaUsed map[string]uint64 `json:"quota_used"`        //requests counted against each tenant's quota today. GET /stats only shows the caller's
 }
 
 // Uses numerically stable recurrence relations to calculate online (running) sample mean/variance:
@@ -35,6 +68,14 @@ func (m *MetricsEngine) AddDuration(duration int64) {
 	atomic.AddInt64(&m.requestMean, d/atomic.AddInt64(&m.requests, 1)) //M_k = M_{k-1} + (x_k - M_{k-1})/k
 }
 
+//Zeroes the request count and mean
+//
+//Each counter is reset atomically, but a request recorded concurrently may be split across the reset
+func (m *MetricsEngine) Reset() {
+	atomic.StoreInt64(&m.requests, 0)
+	atomic.StoreInt64(&m.requestMean, 0)
+}
+
 //Atomically loads snapshot of metrics truncated to milliseconds
 func (m *MetricsEngine) MSSnapshot() *MSMetrics {
 	s := MSMetrics{
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+//How often the autoscaler reconsiders the size of the worker pool
+const scaleInterval = time.Second
+
+//The autoscaler adds workers when the queued backlog would take longer than this to drain
+const scaleDrainTarget = 50 * time.Millisecond
+
+//The autoscaler retires a worker when the queue is empty and workers were busy less than this fraction of the last interval
+const scaleDownUtilization = 0.5
+
+//Sizing and load statistics for the hashing workers
+//
+//Workers report how long they spend hashing and handling requests. Once per scaleInterval the autoscaler
+//compares the queued backlog against mean hash latency to decide whether to grow the pool, and shrinks it one worker
+//at a time while it sits mostly idle. Retired workers finish the request in hand before exiting, so scaling never drops work
+type workerPool struct {
+	workers     int64 //current number of workers, counting ones asked to retire as gone. Accessed atomically
+	busyNanos   int64 //time spent handling requests since the last scaling decision. Accessed atomically
+	hashNanos   int64 //time spent hashing since the last scaling decision. Accessed atomically
+	hashes      int64 //hashes computed since the last scaling decision. Accessed atomically
+	scaleEvents int64 //number of times the pool has been resized. Accessed atomically
+	initial     int
+	min         int
+	max         int
+	interval    time.Duration
+	retire      chan struct{} //each token received retires one worker
+	stop        chan struct{} //closed to stop the autoscaler
+	stopped     chan struct{} //closed once the autoscaler exits
+	scaling     bool          //whether the autoscaler was started
+}
+
+//Sets up pool bounds. A zero min or max means the pool is fixed at initial workers in that direction
+func (p *workerPool) init(initial, min, max int) error {
+	if min == 0 {
+		min = initial
+	}
+	if max == 0 {
+		max = initial
+	}
+	if min < 1 || min > max {
+		return fmt.Errorf("worker pool bounds must satisfy 1 <= min (%d) <= max (%d)", min, max)
+	}
+	if initial < min {
+		initial = min
+	} else if initial > max {
+		initial = max
+	}
+	p.initial = initial
+	p.min = min
+	p.max = max
+	p.interval = scaleInterval
+	p.retire = make(chan struct{}, max)
+	p.stop = make(chan struct{})
+	p.stopped = make(chan struct{})
+	return nil
+}
+
+func (p *workerPool) observeHash(d time.Duration) {
+	atomic.AddInt64(&p.hashNanos, int64(d))
+	atomic.AddInt64(&p.hashes, 1)
+}
+
+func (p *workerPool) observeBusy(d time.Duration) {
+	atomic.AddInt64(&p.busyNanos, int64(d))
+}
+
+//Stops the autoscaler if it's running and waits for it to exit, so no workers are started afterwards
+func (p *workerPool) stopScaling() {
+	if !p.scaling {
+		return
+	}
+	close(p.stop)
+	<-p.stopped
+}
+
+//Works out how many workers the pool should have
+//
+//depth: Requests waiting in the queue
+//
+//hashLatency: Mean time per hash over the last interval. Zero if nothing was hashed
+//
+//utilization: Fraction of the last interval the current workers spent handling requests
+func scaleTarget(workers, depth int, hashLatency time.Duration, utilization float64, min, max int) int {
+	target := workers
+	if depth > 0 {
+		//enough workers to drain the backlog within scaleDrainTarget
+		if hashLatency > 0 {
+			if needed := int(int64(depth)*int64(hashLatency)/int64(scaleDrainTarget)) + 1; needed > target {
+				target = needed
+			}
+		} else if depth > workers {
+			//requests are queued but nothing finished hashing. Grow cautiously
+			target = workers + 1
+		}
+	} else if utilization < scaleDownUtilization {
+		target = workers - 1
+	}
+	if target < min {
+		target = min
+	} else if target > max {
+		target = max
+	}
+	return target
+}
+
+//Periodically resizes the worker pool until stopScaling is called
+func (e *APIEngine) autoscale() {
+	defer close(e.pool.stopped)
+	ticker := time.NewTicker(e.pool.interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-e.pool.stop:
+			return
+		case now := <-ticker.C:
+			e.scale(now.Sub(last))
+			last = now
+		}
+	}
+}
+
+//Makes a single scaling decision based on load over the elapsed interval
+func (e *APIEngine) scale(elapsed time.Duration) {
+	p := &e.pool
+	busy := atomic.SwapInt64(&p.busyNanos, 0)
+	hashNanos := atomic.SwapInt64(&p.hashNanos, 0)
+	hashes := atomic.SwapInt64(&p.hashes, 0)
+	var latency time.Duration
+	if hashes > 0 {
+		latency = time.Duration(hashNanos / hashes)
+	}
+	workers := int(atomic.LoadInt64(&p.workers))
+	var utilization float64
+	if workers > 0 && elapsed > 0 {
+		utilization = float64(busy) / (float64(workers) * float64(elapsed))
+	}
+	depth := e.queueDepth()
+
+	target := scaleTarget(workers, depth, latency, utilization, p.min, p.max)
+	if target == workers {
+		return
+	}
+	for i := workers; i < target; i++ {
+		e.startWorker()
+	}
+	for i := target; i < workers; i++ {
+		atomic.AddInt64(&p.workers, -1)
+		p.retire <- struct{}{}
+	}
+	atomic.AddInt64(&p.scaleEvents, 1)
+	infof("Scaled hashing workers from %d to %d (queue depth %d, mean hash time %s, utilization %.0f%%)", workers, target, depth, latency, utilization*100)
+}
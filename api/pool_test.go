@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScaleTarget(t *testing.T) {
+	cases := []struct {
+		workers, depth int
+		latency        time.Duration
+		utilization    float64
+		expected       int
+	}{
+		{4, 0, time.Millisecond, 0.9, 4},   //busy but keeping up
+		{4, 0, time.Millisecond, 0.1, 3},   //idle. Shrink one at a time
+		{2, 0, 0, 0, 2},                    //never below min
+		{4, 100, time.Millisecond, 1, 4},   //100ms of backlog needs 3 workers. Already have more
+		{4, 1000, time.Millisecond, 1, 16}, //1s of backlog. Capped at max
+		{4, 500, time.Millisecond, 1, 11},  //500ms of backlog drained within 50ms
+		{4, 2, 0, 1, 4},                    //nothing finished but the queue is short
+		{4, 10, 0, 1, 5},                   //nothing finished and the queue is growing
+		{16, 10000, 10 * time.Millisecond, 1, 16},
+	}
+	for i, c := range cases {
+		if actual := scaleTarget(c.workers, c.depth, c.latency, c.utilization, 2, 16); actual != c.expected {
+			t.Errorf("Case %d: Expected target: %d Actual: %d", i, c.expected, actual)
+		}
+	}
+}
+
+func TestAPIEngine_scale(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{Concurrency: 2, MinWorkers: 1, MaxWorkers: 4})
+	e.alive.TestAndSet()
+	e.pool.interval = time.Hour //we drive scaling by hand
+	e.startWorkers()
+
+	//a backlog of slow hashes grows the pool to its max
+	for i := 0; i < 4*e.queueSize; i++ {
+		e.queues[PriorityNormal] <- &HashingRequest{Password: []byte("hunter2"), Sync: true, ReturnChan: make(chan error, 1)}
+	}
+	atomic.StoreInt64(&e.pool.hashNanos, int64(time.Second))
+	atomic.StoreInt64(&e.pool.hashes, 1)
+	e.scale(time.Second)
+	if w := atomic.LoadInt64(&e.pool.workers); w != 4 {
+		t.Errorf("Expected workers: %d Actual: %d", 4, w)
+	}
+
+	//once idle, it shrinks to the min one worker at a time, and retired workers actually exit
+	for e.queueDepth() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		atomic.StoreInt64(&e.pool.busyNanos, 0)
+		e.scale(time.Second)
+	}
+	if w := atomic.LoadInt64(&e.pool.workers); w != 1 {
+		t.Errorf("Expected workers: %d Actual: %d", 1, w)
+	}
+	if n := atomic.LoadInt64(&e.pool.scaleEvents); n != 4 {
+		t.Errorf("Expected scale events: %d Actual: %d", 4, n)
+	}
+	e.pool.stopScaling()
+	for _, q := range e.queues {
+		close(q)
+	}
+	e.wg.Wait()
+}
+
+func TestWorkerPool_initBounds(t *testing.T) {
+	var p workerPool
+	if err := p.init(8, 2, 4); err != nil || p.initial != 4 {
+		t.Errorf("Expected initial workers clamped to 4. Actual: %d (%v)", p.initial, err)
+	}
+	if err := p.init(2, 4, 3); err == nil {
+		t.Error("Expected error for min above max")
+	}
+	if err := p.init(4, 0, 0); err != nil || p.min != 4 || p.max != 4 {
+		t.Errorf("Expected fixed pool of 4. Actual: %d-%d (%v)", p.min, p.max, err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+//Hashing request priority class
+type Priority int
+
+const (
+	PriorityInteractive Priority = iota //logins and anything else a person is waiting on
+	PriorityNormal                      //default
+	PriorityBulk                        //imports, migrations and other batch work
+	numPriorities
+)
+
+//Header clients use to tag hashing requests with a priority class
+const PriorityHeader = "X-Priority"
+
+var priorityNames = [numPriorities]string{"interactive", "normal", "bulk"}
+
+//Share of the workers each class gets while every class has requests queued
+var priorityWeights = [numPriorities]int{8, 4, 1}
+
+//Order in which workers favour classes, interleaved so no class waits a whole cycle
+var prioritySchedule = buildPrioritySchedule(priorityWeights)
+
+var ErrUnknownPriority error = errors.New("priority must be one of 'interactive', 'normal' or 'bulk'")
+
+//Parses a priority class name. An empty name means PriorityNormal
+func ParsePriority(s string) (Priority, error) {
+	if s == "" {
+		return PriorityNormal, nil
+	}
+	for p, name := range priorityNames {
+		if s == name {
+			return Priority(p), nil
+		}
+	}
+	return PriorityNormal, ErrUnknownPriority
+}
+
+func (p Priority) String() string {
+	return priorityNames[p]
+}
+
+//Smooth weighted round robin. Each class appears weight times and is spread as evenly as possible
+func buildPrioritySchedule(weights [numPriorities]int) []Priority {
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	var current [numPriorities]int
+	schedule := make([]Priority, 0, total)
+	for i := 0; i < total; i++ {
+		best := 0
+		for p := range weights {
+			current[p] += weights[p]
+			if current[p] > current[best] {
+				best = p
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, Priority(best))
+	}
+	return schedule
+}
+
+//Counters for a single priority class. Accessed atomically
+type classStats struct {
+	served    int64 //requests picked up by a worker
+	shed      int64 //requests rejected because the class's queue stayed full
+	waitNanos int64 //total time served requests spent queued
+}
+
+//Picks the next request for a worker, blocking until one arrives
+//
+//While several classes have requests queued they're served in proportion to priorityWeights, so bulk work can't
+//starve interactive requests and interactive bursts can't starve bulk work entirely. When only one class has work,
+//it gets every worker. pos is the worker's position in prioritySchedule.
+//Closed queues are set to nil in queues. Returns nil once every queue is closed and drained, or the worker is retired
+func (e *APIEngine) nextRequest(queues *[numPriorities]chan *HashingRequest, pos *int) *HashingRequest {
+	favoured := prioritySchedule[*pos]
+	*pos = (*pos + 1) % len(prioritySchedule)
+	for {
+		//try the favoured class first, then the rest from highest priority down
+		open := false
+		for i := -1; i < int(numPriorities); i++ {
+			p := favoured
+			if i >= 0 {
+				if p = Priority(i); p == favoured {
+					continue
+				}
+			}
+			if queues[p] == nil {
+				continue
+			}
+			select {
+			case r, ok := <-queues[p]:
+				if !ok {
+					queues[p] = nil
+					continue
+				}
+				return r
+			default:
+				open = true
+			}
+		}
+		if !open {
+			return nil
+		}
+		//nothing queued anywhere. Wait for whatever arrives first
+		select {
+		case r, ok := <-queues[PriorityInteractive]:
+			if !ok {
+				queues[PriorityInteractive] = nil
+				continue
+			}
+			return r
+		case r, ok := <-queues[PriorityNormal]:
+			if !ok {
+				queues[PriorityNormal] = nil
+				continue
+			}
+			return r
+		case r, ok := <-queues[PriorityBulk]:
+			if !ok {
+				queues[PriorityBulk] = nil
+				continue
+			}
+			return r
+		case <-e.pool.retire:
+			return nil
+		}
+	}
+}
+
+//Records that a worker picked up r
+func (e *APIEngine) observeServed(r *HashingRequest) {
+	s := &e.classes[r.Priority]
+	atomic.AddInt64(&s.served, 1)
+	atomic.AddInt64(&s.waitNanos, int64(time.Since(r.Enqueued)))
+}
+
+//Snapshot of per-class queue metrics for GET /stats
+func (e *APIEngine) classMetrics() map[string]*ClassMetrics {
+	m := make(map[string]*ClassMetrics, numPriorities)
+	for p := Priority(0); p < numPriorities; p++ {
+		s := &e.classes[p]
+		c := &ClassMetrics{
+			Queued: uint64(len(e.queues[p])),
+			Served: uint64(atomic.LoadInt64(&s.served)),
+			Shed:   uint64(atomic.LoadInt64(&s.shed)),
+		}
+		if c.Served > 0 {
+			c.AverageWait = uint64(atomic.LoadInt64(&s.waitNanos)) / c.Served / 1000000
+		}
+		m[p.String()] = c
+	}
+	return m
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParsePriority(t *testing.T) {
+	for s, expected := range map[string]Priority{"": PriorityNormal, "interactive": PriorityInteractive, "normal": PriorityNormal, "bulk": PriorityBulk} {
+		if p, err := ParsePriority(s); err != nil || p != expected {
+			t.Errorf("%q: Expected: %s Actual: %s (%v)", s, expected, p, err)
+		}
+	}
+	if _, err := ParsePriority("urgent"); err != ErrUnknownPriority {
+		t.Errorf("Expected: %v Actual: %v", ErrUnknownPriority, err)
+	}
+}
+
+func TestBuildPrioritySchedule(t *testing.T) {
+	schedule := buildPrioritySchedule([numPriorities]int{2, 1, 1})
+	expected := []Priority{PriorityInteractive, PriorityNormal, PriorityBulk, PriorityInteractive}
+	if len(schedule) != len(expected) {
+		t.Fatalf("Expected schedule: %v Actual: %v", expected, schedule)
+	}
+	for i := range expected {
+		if schedule[i] != expected[i] {
+			t.Fatalf("Expected schedule: %v Actual: %v", expected, schedule)
+		}
+	}
+}
+
+//With every class backlogged, each gets its weighted share. Once a class runs dry the others take up the slack
+func TestAPIEngine_nextRequest(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{Concurrency: 1, QueueSize: 1000 * int(numPriorities)})
+	for p := range e.queues {
+		for i := 0; i < 1000; i++ {
+			e.queues[p] <- &HashingRequest{Priority: Priority(p)}
+		}
+	}
+	queues := e.queues
+	pos := 0
+	var served [numPriorities]int
+	for i := 0; i < 10*len(prioritySchedule); i++ {
+		served[e.nextRequest(&queues, &pos).Priority]++
+	}
+	for p, w := range priorityWeights {
+		if served[p] != 10*w {
+			t.Errorf("%s: Expected served: %d Actual: %d", Priority(p), 10*w, served[p])
+		}
+	}
+
+	//drain interactive and bulk, leaving only normal
+	for len(e.queues[PriorityInteractive]) > 0 {
+		<-e.queues[PriorityInteractive]
+	}
+	for len(e.queues[PriorityBulk]) > 0 {
+		<-e.queues[PriorityBulk]
+	}
+	for i := 0; i < len(prioritySchedule); i++ {
+		if r := e.nextRequest(&queues, &pos); r.Priority != PriorityNormal {
+			t.Fatalf("Expected: %s Actual: %s", PriorityNormal, r.Priority)
+		}
+	}
+
+	for _, q := range e.queues {
+		close(q)
+	}
+	n := 0
+	for e.nextRequest(&queues, &pos) != nil {
+		n++
+	}
+	if remaining := 1000 - 10*priorityWeights[PriorityNormal] - len(prioritySchedule); n != remaining {
+		t.Errorf("Expected remaining: %d Actual: %d", remaining, n)
+	}
+}
+
+func TestAPIEngine_onHashPostPriority(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{})
+	e.alive.TestAndSet()
+	e.startWorkers()
+
+	req := httptest.NewRequest("POST", "/hash?sync=true", strings.NewReader("hunter2"))
+	req.Header.Set(PriorityHeader, "interactive")
+	w := httptest.NewRecorder()
+	e.onHashPost(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status: %d Actual: %d (%s)", http.StatusOK, w.Code, w.Body.String())
+	}
+	if c := e.classMetrics(); c["interactive"].Served != 1 || c["normal"].Served != 0 {
+		t.Errorf("Request was not served as interactive: %+v %+v", c["interactive"], c["normal"])
+	}
+
+	req = httptest.NewRequest("POST", "/hash", strings.NewReader("hunter2"))
+	req.Header.Set(PriorityHeader, "urgent")
+	w = httptest.NewRecorder()
+	e.onHashPost(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status: %d Actual: %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestAPIEngine_parseHashOptionsPriorityCap(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{})
+	for _, c := range []struct {
+		tenant   *Tenant
+		header   string
+		expected Priority
+	}{
+		{NewTenant("reporting", PriorityBulk, testTenantSecret), "", PriorityBulk},
+		{NewTenant("reporting", PriorityBulk, testTenantSecret), "interactive", PriorityBulk},
+		{NewTenant("payments", PriorityNormal, testTenantSecret), "interactive", PriorityNormal},
+		{NewTenant("payments", PriorityNormal, testTenantSecret), "bulk", PriorityBulk},
+		{NewTenant("frontend", PriorityInteractive, testTenantSecret), "interactive", PriorityInteractive},
+		{nil, "interactive", PriorityInteractive},
+	} {
+		req := httptest.NewRequest("POST", "/hash", strings.NewReader("hunter2"))
+		req, a := withRequestAuth(req)
+		a.Tenant = c.tenant
+		if c.header != "" {
+			req.Header.Set(PriorityHeader, c.header)
+		}
+		r, err := e.parseHashOptions(req, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Priority != c.expected {
+			t.Errorf("Tenant %q asking for %q: Expected: %s Actual: %s", tenantName(c.tenant), c.header, c.expected, r.Priority)
+		}
+	}
+}
+
+func TestAPIEngine_queueCapacity(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{Concurrency: 2, QueueSize: 64})
+	total := 0
+	for p, q := range e.queues {
+		if cap(q) < 64*2/int(numPriorities) {
+			t.Errorf("%s: queue holds only %d requests", Priority(p), cap(q))
+		}
+		total += cap(q)
+	}
+	if total < 64*2 || total >= 64*2+int(numPriorities) {
+		t.Errorf("Expected the classes to share %d slots. Actual: %d", 64*2, total)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//How often idle buckets and stale quota counters are dropped
+const limiterSweepInterval = time.Minute
+
+//Reasons a request can be rate limited, as reported in stats
+const (
+	limitReasonIP    = "ip"
+	limitReasonKey   = "key"
+	limitReasonQuota = "quota"
+)
+
+var ErrRateLimited error = errors.New("rate limit exceeded")
+
+//Limits applied to hashing requests. Zero rates and quotas mean unlimited
+//
+//Rates are enforced with token buckets: a client may make burst requests at once, then rate requests per second
+type RateLimits struct {
+	KeyRate      float64          `json:"key_rate"`                //requests per second per API key
+	KeyBurst     int              `json:"key_burst"`               //bucket size per API key. If 0, the rate rounded up
+	IPRate       float64          `json:"ip_rate"`                 //requests per second per source IP
+	IPBurst      int              `json:"ip_burst"`                //bucket size per source IP. If 0, the rate rounded up
+	DailyQuota   int64            `json:"daily_quota"`             //requests per tenant per UTC day
+	TenantQuotas map[string]int64 `json:"tenant_quotas,omitempty"` //per tenant overrides of DailyQuota
+}
+
+//Bucket size for rate and burst
+func bucketSize(rate float64, burst int) float64 {
+	if burst > 0 {
+		return float64(burst)
+	}
+	return math.Max(1, math.Ceil(rate))
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//Adds the tokens accrued since the bucket was last touched
+func (b *tokenBucket) refill(now time.Time, rate, size float64) {
+	b.tokens = math.Min(size, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+//Requests a tenant has made on a UTC day
+type quotaUsage struct {
+	day  int64 //days since the epoch
+	used int64
+}
+
+//Outcome of a rate limit check, for the RateLimit-* headers
+//
+//Describes whichever limit is closest to being exhausted
+type rateDecision struct {
+	Allowed    bool
+	Reason     string        //limit that rejected the request
+	Limit      int64         //size of the limit
+	Remaining  int64         //requests left before the limit is hit
+	Reset      time.Duration //until the limit is back to full
+	RetryAfter time.Duration //until the next request would be allowed, for rejected requests
+}
+
+//Token bucket rate limiter keyed by API key and source IP, with daily quotas per tenant
+type RateLimiter struct {
+	limits    RateLimits
+	keys      map[string]*tokenBucket
+	ips       map[string]*tokenBucket
+	quotas    map[string]*quotaUsage
+	limited   map[string]uint64 //rejected requests by reason
+	lastSweep time.Time
+	now       func() time.Time
+	lock      sync.Mutex
+}
+
+//Creates a new RateLimiter enforcing limits
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	var l RateLimiter
+	l.keys = make(map[string]*tokenBucket)
+	l.ips = make(map[string]*tokenBucket)
+	l.quotas = make(map[string]*quotaUsage)
+	l.limited = make(map[string]uint64)
+	l.now = time.Now
+	l.lastSweep = l.now()
+	l.SetLimits(limits)
+	return &l
+}
+
+//Replaces the limits in effect. Existing buckets keep their tokens, capped to the new bucket sizes
+func (l *RateLimiter) SetLimits(limits RateLimits) {
+	quotas := make(map[string]int64, len(limits.TenantQuotas))
+	for t, q := range limits.TenantQuotas {
+		quotas[t] = q
+	}
+	limits.TenantQuotas = quotas
+	l.lock.Lock()
+	l.limits = limits
+	l.lock.Unlock()
+}
+
+//Copy of the limits in effect
+func (l *RateLimiter) Limits() RateLimits {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	limits := l.limits
+	limits.TenantQuotas = make(map[string]int64, len(l.limits.TenantQuotas))
+	for t, q := range l.limits.TenantQuotas {
+		limits.TenantQuotas[t] = q
+	}
+	return limits
+}
+
+//Daily quota for tenant. Must be called with lock held
+func (l *RateLimiter) quota(tenant string) int64 {
+	if q, exists := l.limits.TenantQuotas[tenant]; exists {
+		return q
+	}
+	return l.limits.DailyQuota
+}
+
+func (l *RateLimiter) bucket(buckets map[string]*tokenBucket, id string, rate, size float64, now time.Time) *tokenBucket {
+	b, exists := buckets[id]
+	if !exists {
+		b = &tokenBucket{tokens: size, last: now}
+		buckets[id] = b
+	}
+	b.refill(now, rate, size)
+	return b
+}
+
+//Charges a request from ip on behalf of t against every applicable limit
+//
+//The request is only charged if every limit allows it. t is nil when API keys are disabled, in which case only
+//the per IP limit applies
+func (l *RateLimiter) Allow(ip string, t *Tenant) rateDecision {
+	now := l.now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sweep(now)
+
+	type bucketCheck struct {
+		reason     string
+		b          *tokenBucket
+		rate, size float64
+	}
+	checks := make([]bucketCheck, 0, 2)
+	if l.limits.IPRate > 0 && ip != "" {
+		size := bucketSize(l.limits.IPRate, l.limits.IPBurst)
+		checks = append(checks, bucketCheck{limitReasonIP, l.bucket(l.ips, ip, l.limits.IPRate, size, now), l.limits.IPRate, size})
+	}
+	if l.limits.KeyRate > 0 && t != nil {
+		size := bucketSize(l.limits.KeyRate, l.limits.KeyBurst)
+		checks = append(checks, bucketCheck{limitReasonKey, l.bucket(l.keys, t.keyID, l.limits.KeyRate, size, now), l.limits.KeyRate, size})
+	}
+	var usage *quotaUsage
+	quota := int64(0)
+	day := now.UTC().Unix() / 86400
+	if t != nil {
+		if quota = l.quota(t.Name); quota > 0 {
+			if usage = l.quotas[t.Name]; usage == nil || usage.day != day {
+				usage = &quotaUsage{day: day}
+				l.quotas[t.Name] = usage
+			}
+		}
+	}
+	untilMidnight := time.Unix((day+1)*86400, 0).Sub(now)
+
+	//reject without charging anything if any limit is exhausted
+	for _, c := range checks {
+		if c.b.tokens < 1 {
+			l.limited[c.reason]++
+			return rateDecision{
+				Reason:     c.reason,
+				Limit:      int64(c.size),
+				Reset:      seconds((c.size - c.b.tokens) / c.rate),
+				RetryAfter: seconds((1 - c.b.tokens) / c.rate),
+			}
+		}
+	}
+	if usage != nil && usage.used >= quota {
+		l.limited[limitReasonQuota]++
+		return rateDecision{Reason: limitReasonQuota, Limit: quota, Reset: untilMidnight, RetryAfter: untilMidnight}
+	}
+
+	d := rateDecision{Allowed: true, Remaining: -1}
+	for _, c := range checks {
+		c.b.tokens--
+		if remaining := int64(c.b.tokens); d.Remaining < 0 || remaining < d.Remaining {
+			d.Limit, d.Remaining = int64(c.size), remaining
+			d.Reset = seconds((c.size - c.b.tokens) / c.rate)
+		}
+	}
+	if usage != nil {
+		usage.used++
+		if remaining := quota - usage.used; d.Remaining < 0 || remaining < d.Remaining {
+			d.Limit, d.Remaining, d.Reset = quota, remaining, untilMidnight
+		}
+	}
+	return d
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+//Drops buckets that have refilled completely and quota counters from earlier days. Must be called with lock held
+//
+//A dropped bucket is indistinguishable from a new one, so this only bounds memory
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for _, s := range []struct {
+		buckets    map[string]*tokenBucket
+		rate, size float64
+	}{
+		{l.ips, l.limits.IPRate, bucketSize(l.limits.IPRate, l.limits.IPBurst)},
+		{l.keys, l.limits.KeyRate, bucketSize(l.limits.KeyRate, l.limits.KeyBurst)},
+	} {
+		for id, b := range s.buckets {
+			if s.rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*s.rate >= s.size {
+				delete(s.buckets, id)
+			}
+		}
+	}
+	day := now.UTC().Unix() / 86400
+	for t, u := range l.quotas {
+		if u.day != day {
+			delete(l.quotas, t)
+		}
+	}
+}
+
+//Snapshot of limiter state for GET /stats
+func (l *RateLimiter) Metrics() *LimiterMetrics {
+	limits := l.Limits()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	m := &LimiterMetrics{
+		Limits:    limits,
+		Buckets:   uint64(len(l.keys) + len(l.ips)),
+		Limited:   make(map[string]uint64, len(l.limited)),
+		QuotaUsed: make(map[string]uint64, len(l.quotas)),
+	}
+	for r, n := range l.limited {
+		m.Limited[r] = n
+	}
+	day := l.now().UTC().Unix() / 86400
+	for t, u := range l.quotas {
+		if u.day == day {
+			m.QuotaUsed[t] = uint64(u.used)
+		}
+	}
+	return m
+}
+
+//Snapshot of limiter state as tenant t may see it, for GET /stats
+//
+//Only t's own quota override and usage are included. Bucket and rejection counts cover every client, so they're left out
+func (l *RateLimiter) TenantMetrics(t *Tenant) *LimiterMetrics {
+	limits := l.Limits()
+	quotas := limits.TenantQuotas
+	limits.TenantQuotas = nil
+	m := &LimiterMetrics{Limits: limits, QuotaUsed: make(map[string]uint64, 1)}
+	if t == nil {
+		return m
+	}
+	if q, exists := quotas[t.Name]; exists {
+		m.Limits.TenantQuotas = map[string]int64{t.Name: q}
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if u := l.quotas[t.Name]; u != nil && u.day == l.now().UTC().Unix()/86400 {
+		m.QuotaUsed[t.Name] = uint64(u.used)
+	}
+	return m
+}
+
+//Zeroes the rejected request counters. Buckets and quota usage are unaffected
+func (l *RateLimiter) ResetCounters() {
+	l.lock.Lock()
+	l.limited = make(map[string]uint64)
+	l.lock.Unlock()
+}
+
+//Source IP of a request. Forwarding headers are ignored since any client can set them
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+//Whole seconds in d, rounded up, for headers
+func headerSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+//Checks a hashing request against the rate limits, setting the RateLimit-* headers
+//
+//Returns false after responding with a 429 if the request was rejected
+func (e *APIEngine) rateLimit(w http.ResponseWriter, req *http.Request) bool {
+	d := e.limiter.Allow(clientIP(req), requestTenant(req))
+	if d.Limit == 0 {
+		return true //no limits apply
+	}
+	w.Header().Set("RateLimit-Limit", strconv.FormatInt(d.Limit, 10))
+	w.Header().Set("RateLimit-Remaining", strconv.FormatInt(d.Remaining, 10))
+	w.Header().Set("RateLimit-Reset", headerSeconds(d.Reset))
+	if !d.Allowed {
+		w.Header().Set("Retry-After", headerSeconds(d.RetryAfter))
+		http.Error(w, fmt.Sprintf("%s: %s limit", ErrRateLimited.Error(), d.Reason), http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	now := time.Date(2017, 4, 7, 23, 59, 0, 0, time.UTC)
+	l := NewRateLimiter(RateLimits{KeyRate: 2, KeyBurst: 3, IPRate: 10})
+	l.now = func() time.Time { return now }
+	l.lastSweep = now
+	a := NewTenant("team-a", PriorityNormal, testTenantSecret)
+	a.keyID = "a"
+
+	//the burst is available straight away, then requests are refused until tokens accrue
+	for i := 0; i < 3; i++ {
+		if d := l.Allow("10.0.0.1", a); !d.Allowed || d.Remaining != int64(2-i) || d.Limit != 3 {
+			t.Fatalf("Request %d: Unexpected decision: %+v", i, d)
+		}
+	}
+	d := l.Allow("10.0.0.1", a)
+	if d.Allowed || d.Reason != limitReasonKey || d.RetryAfter != 500*time.Millisecond {
+		t.Errorf("Unexpected decision: %+v", d)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if d := l.Allow("10.0.0.1", a); !d.Allowed {
+		t.Errorf("Expected request allowed after refill: %+v", d)
+	}
+
+	//other keys and IPs have their own buckets
+	b := NewTenant("team-b", PriorityNormal, testTenantSecret)
+	b.keyID = "b"
+	if d := l.Allow("10.0.0.1", b); !d.Allowed {
+		t.Errorf("Unexpected decision for second key: %+v", d)
+	}
+	l.SetLimits(RateLimits{IPRate: 1})
+	if d := l.Allow("10.0.0.2", nil); !d.Allowed || d.Limit != 1 {
+		t.Errorf("Unexpected decision for new IP: %+v", d)
+	}
+	if d := l.Allow("10.0.0.2", nil); d.Allowed || d.Reason != limitReasonIP {
+		t.Errorf("Unexpected decision for exhausted IP: %+v", d)
+	}
+
+	//quotas reset at midnight UTC
+	l.SetLimits(RateLimits{DailyQuota: 2, TenantQuotas: map[string]int64{"team-b": 1}})
+	for i := 0; i < 2; i++ {
+		if d := l.Allow("", a); !d.Allowed {
+			t.Fatalf("Request %d: Unexpected decision: %+v", i, d)
+		}
+	}
+	if d := l.Allow("", a); d.Allowed || d.Reason != limitReasonQuota || d.RetryAfter != 59500*time.Millisecond {
+		t.Errorf("Unexpected decision over quota: %+v", d)
+	}
+	if d := l.Allow("", b); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("Unexpected decision for overridden quota: %+v", d)
+	}
+	m := l.Metrics()
+	if m.QuotaUsed["team-a"] != 2 || m.Limited[limitReasonKey] != 1 || m.Limited[limitReasonIP] != 1 || m.Limited[limitReasonQuota] != 1 {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+	now = now.Add(time.Minute)
+	if d := l.Allow("", a); !d.Allowed {
+		t.Errorf("Expected quota reset at midnight: %+v", d)
+	}
+
+	//idle buckets and old quotas are swept
+	now = now.Add(24 * time.Hour)
+	l.SetLimits(RateLimits{IPRate: 1})
+	l.Allow("10.0.0.3", nil)
+	if m := l.Metrics(); m.Buckets != 1 || len(m.QuotaUsed) != 0 {
+		t.Errorf("Unexpected metrics after sweep: %+v", m)
+	}
+}
+
+//GET /stats callers only see their own tenant's quota
+func TestAPIEngine_onStatsGetLimiter(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{RateLimits: RateLimits{DailyQuota: 10, TenantQuotas: map[string]int64{"team-a": 5, "team-b": 20}}})
+	a := NewTenant("team-a", PriorityNormal, testTenantSecret)
+	b := NewTenant("team-b", PriorityNormal, testTenantSecret)
+	e.limiter.Allow("10.0.0.1", a)
+	e.limiter.Allow("10.0.0.2", b)
+	e.limiter.Allow("10.0.0.2", b)
+	get := func(tenant *Tenant) *MSMetrics {
+		req, auth := withRequestAuth(httptest.NewRequest("GET", "/stats", nil))
+		auth.Tenant = tenant
+		w := httptest.NewRecorder()
+		e.onStatsGet(w, req)
+		var snap MSMetrics
+		if err := json.Unmarshal(w.Body.Bytes(), &snap); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(w.Body.String(), "team-b") && tenant != b {
+			t.Errorf("Another tenant's limiter state leaked: %s", w.Body.String())
+		}
+		return &snap
+	}
+	if m := get(a).Limiter; m.QuotaUsed["team-a"] != 1 || len(m.QuotaUsed) != 1 || m.Limits.TenantQuotas["team-a"] != 5 || len(m.Limits.TenantQuotas) != 1 || m.Limits.DailyQuota != 10 {
+		t.Errorf("Unexpected limiter state for team-a: %+v", m)
+	}
+	if m := get(nil).Limiter; len(m.QuotaUsed) != 0 || len(m.Limits.TenantQuotas) != 0 {
+		t.Errorf("Unexpected limiter state for the default tenant: %+v", m)
+	}
+	if m := e.stats().Limiter; m.QuotaUsed["team-a"] != 1 || m.QuotaUsed["team-b"] != 2 || len(m.Limits.TenantQuotas) != 2 {
+		t.Errorf("Unexpected full limiter state: %+v", m)
+	}
+}
+
+func TestAPIEngine_rateLimit(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{RateLimits: RateLimits{IPRate: 0.5, IPBurst: 1}})
+	e.alive.TestAndSet()
+	e.startWorkers()
+	defer e.Stop()
+	post := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		e.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/hash?delay=0", strings.NewReader("hunter2")))
+		return w
+	}
+	if w := post(); w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "0" || w.Header().Get("RateLimit-Reset") != "2" {
+		t.Errorf("Unexpected response: %d %v", w.Code, w.Header())
+	}
+	w := post()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("RateLimit-Limit") != "1" || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("Unexpected response: %d %v", w.Code, w.Header())
+	}
+	if n := e.stats().Limiter.Limited[limitReasonIP]; n != 1 {
+		t.Errorf("Expected rate limited: %d Actual: %d", 1, n)
+	}
+}
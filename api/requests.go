@@ -1,11 +1,23 @@
 package main
 
-import "github.com/iamthebot/jumphasher/common"
+import (
+	"github.com/iamthebot/jumphasher/common"
+	"time"
+)
 
 type HashingRequest struct {
-	ID         jumphasher.UUID
-	Password   []byte
-	ReturnChan chan error
+	ID          jumphasher.UUID //job ID as stored, i.e. already mapped into Tenant's namespace
+	Password    []byte
+	ReturnChan  chan error
+	CallbackURL string        //if not empty, a webhook is sent here once the hash is available
+	Delay       time.Duration //how long after hashing the result becomes available
+	AvailableAt time.Time     //if not zero, overrides Delay with an absolute availability time
+	Sync        bool          //if true, the worker hands the hash back in Hash rather than scheduling it
+	Store       bool          //for Sync requests, whether to also record the hash in the store
+	Hash        []byte        //set by the worker for Sync requests before it replies on ReturnChan
+	Priority    Priority      //priority class, which decides the queue the request waits in
+	Enqueued    time.Time     //when the request was queued, for per-class wait metrics
+	Tenant      *Tenant       //tenant the request was made by. nil when API keys are disabled
 }
 
 type HashingResponse struct {
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"github.com/iamthebot/jumphasher/common"
+	"sync"
+	"time"
+)
+
+//Default bound on the number of jobs waiting out their delay
+const DefaultMaxBacklog = 1000000
+
+//Most jobs handed to the flush function in one go
+const schedulerMaxBatch = 512
+
+var ErrSchedulerFull error = errors.New("too many jobs waiting to be persisted")
+var ErrSchedulerClosed error = errors.New("scheduler is shutting down")
+
+//A hashed job waiting for its delay to elapse before being persisted
+type ScheduledJob struct {
+	ID          jumphasher.UUID
+	Hash        []byte
+	Due         time.Time
+	CallbackURL string
+	Tenant      *Tenant //owner of the job. ID is already in its namespace
+	index       int     //position in the heap
+}
+
+//min-heap of jobs ordered by due time
+type jobHeap []*ScheduledJob
+
+func (h jobHeap) Len() int           { return len(h) }
+func (h jobHeap) Less(i, j int) bool { return h[i].Due.Before(h[j].Due) }
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *jobHeap) Push(x interface{}) {
+	j := x.(*ScheduledJob)
+	j.index = len(*h)
+	*h = append(*h, j)
+}
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	j := old[n-1]
+	old[n-1] = nil
+	j.index = -1
+	*h = old[:n-1]
+	return j
+}
+
+//Heap-based delay scheduler
+//
+//Replaces a sleeping goroutine per job with a single goroutine and a single timer armed for the earliest due job.
+//Due jobs are handed to flush in batches of up to schedulerMaxBatch. The number of waiting jobs is bounded
+//by capacity so memory use stays bounded under overload
+type DelayScheduler struct {
+	jobs     jobHeap
+	byID     map[jumphasher.UUID]*ScheduledJob //waiting jobs, for cancellation
+	capacity int
+	flush    func(jobs []*ScheduledJob)
+	lock     sync.Mutex
+	wake     chan struct{} //nudges the run loop when an earlier job arrives
+	started  bool          //the run loop has been started
+	closing  bool          //no new jobs are accepted. The run loop exits once the heap drains
+	abandon  bool          //the run loop exits without waiting for the heap to drain
+	flushAll bool          //waiting jobs are flushed straight away rather than when they come due
+	done     chan struct{} //closed when the run loop exits
+}
+
+//Creates a new DelayScheduler
+//
+//Jobs may be scheduled straight away, but nothing is flushed until Start
+//
+//capacity: Maximum number of waiting jobs
+//
+//flush: Called from the run loop with batches of due jobs
+func NewDelayScheduler(capacity int, flush func(jobs []*ScheduledJob)) *DelayScheduler {
+	var s DelayScheduler
+	s.capacity = capacity
+	s.flush = flush
+	s.byID = make(map[jumphasher.UUID]*ScheduledJob)
+	s.wake = make(chan struct{}, 1)
+	s.done = make(chan struct{})
+	return &s
+}
+
+//Starts the run loop, which flushes jobs as they come due. Does nothing if it's already running
+func (s *DelayScheduler) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	go s.run()
+}
+
+//Schedule a job to be flushed at j.Due
+func (s *DelayScheduler) Schedule(j *ScheduledJob) error {
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		return ErrSchedulerClosed
+	}
+	if len(s.jobs) >= s.capacity {
+		s.lock.Unlock()
+		return ErrSchedulerFull
+	}
+	heap.Push(&s.jobs, j)
+	s.byID[j.ID] = j
+	earliest := s.jobs[0] == j
+	s.lock.Unlock()
+	if earliest {
+		s.nudge()
+	}
+	return nil
+}
+
+//Schedule a job regardless of capacity
+//
+//Used to restore jobs that were already acknowledged before a restart, which we can't turn away
+func (s *DelayScheduler) Restore(j *ScheduledJob) error {
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		return ErrSchedulerClosed
+	}
+	heap.Push(&s.jobs, j)
+	s.byID[j.ID] = j
+	s.lock.Unlock()
+	s.nudge()
+	return nil
+}
+
+//Removes a waiting job so it's never flushed
+//
+//Returns false if no job with that ID is waiting, either because it was never scheduled or because it has already
+//been handed to flush
+func (s *DelayScheduler) Cancel(id *jumphasher.UUID) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	j, exists := s.byID[*id]
+	if !exists {
+		return false
+	}
+	heap.Remove(&s.jobs, j.index)
+	delete(s.byID, *id)
+	return true
+}
+
+//Number of jobs waiting out their delay
+func (s *DelayScheduler) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.jobs)
+}
+
+//Stops accepting jobs and blocks until every waiting job has come due and been flushed
+//
+//Starts the run loop if it was never started, so the waiting jobs still get flushed
+func (s *DelayScheduler) Close() {
+	s.lock.Lock()
+	s.closing = true
+	s.lock.Unlock()
+	s.Start()
+	s.nudge()
+	<-s.done
+}
+
+//Stops accepting jobs and blocks until every waiting job has been flushed, without waiting for them to come due
+//
+//Used at shutdown when nothing else would remember waiting jobs, since they may be due hours from now
+func (s *DelayScheduler) Flush() {
+	s.lock.Lock()
+	s.closing = true
+	s.flushAll = true
+	s.lock.Unlock()
+	s.Start()
+	s.nudge()
+	<-s.done
+}
+
+//Stops accepting jobs and stops the run loop without flushing waiting jobs, returning how many were left
+//
+//Used when waiting jobs are durable elsewhere, such as in a JobJournal, and will be restored on the next start
+func (s *DelayScheduler) Abandon() int {
+	s.lock.Lock()
+	s.closing = true
+	s.abandon = true
+	started := s.started
+	s.lock.Unlock()
+	if started {
+		s.nudge()
+		<-s.done
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.jobs)
+}
+
+func (s *DelayScheduler) nudge() {
+	select {
+	case s.wake <- struct{}{}:
+	default: //already pending
+	}
+}
+
+func (s *DelayScheduler) run() {
+	defer close(s.done)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	batch := make([]*ScheduledJob, 0, schedulerMaxBatch)
+	for {
+		s.lock.Lock()
+		if s.abandon {
+			s.lock.Unlock()
+			return
+		}
+		now := time.Now()
+		batch = batch[:0]
+		for len(s.jobs) > 0 && len(batch) < schedulerMaxBatch && (s.flushAll || !s.jobs[0].Due.After(now)) {
+			j := heap.Pop(&s.jobs).(*ScheduledJob)
+			if s.byID[j.ID] == j {
+				delete(s.byID, j.ID)
+			}
+			batch = append(batch, j)
+		}
+		var next time.Duration = -1
+		if len(s.jobs) > 0 {
+			next = s.jobs[0].Due.Sub(now)
+		}
+		finished := s.closing && len(s.jobs) == 0
+		s.lock.Unlock()
+
+		if len(batch) > 0 {
+			s.flush(batch)
+			if len(batch) == schedulerMaxBatch {
+				continue //there may be more due right now
+			}
+		}
+		if finished {
+			return
+		}
+		if next >= 0 {
+			timer.Reset(next)
+		}
+		//a stale tick after Stop just costs us an extra pass through the loop
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"github.com/iamthebot/jumphasher/common"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDelayScheduler_Schedule(t *testing.T) {
+	var lock sync.Mutex
+	var flushed []*ScheduledJob
+	batches := 0
+	s := NewDelayScheduler(100, func(jobs []*ScheduledJob) {
+		lock.Lock()
+		flushed = append(flushed, jobs...)
+		batches++
+		lock.Unlock()
+	})
+	s.Start()
+
+	//schedule out of order. They must come out in due order
+	now := time.Now()
+	delays := []time.Duration{80, 20, 60, 40}
+	for _, d := range delays {
+		u, _ := jumphasher.UUIDv4()
+		if err := s.Schedule(&ScheduledJob{ID: *u, Due: now.Add(d * time.Millisecond)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Len() != len(delays) {
+		t.Errorf("Expected backlog: %d Actual: %d", len(delays), s.Len())
+	}
+	time.Sleep(10 * time.Millisecond)
+	lock.Lock()
+	if len(flushed) != 0 {
+		t.Error("Jobs flushed before they were due")
+	}
+	lock.Unlock()
+
+	s.Close()
+	if len(flushed) != len(delays) {
+		t.Fatalf("Expected flushed: %d Actual: %d", len(delays), len(flushed))
+	}
+	for i := 1; i < len(flushed); i++ {
+		if flushed[i].Due.Before(flushed[i-1].Due) {
+			t.Error("Jobs flushed out of order")
+		}
+	}
+	if time.Since(now) < 80*time.Millisecond {
+		t.Error("Close returned before the last job was due")
+	}
+	if err := s.Schedule(&ScheduledJob{Due: now}); err != ErrSchedulerClosed {
+		t.Errorf("Expected: %v Actual: %v", ErrSchedulerClosed, err)
+	}
+}
+
+func TestDelayScheduler_Capacity(t *testing.T) {
+	s := NewDelayScheduler(2, func(jobs []*ScheduledJob) {})
+	s.Start()
+	due := time.Now().Add(50 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if err := s.Schedule(&ScheduledJob{Due: due}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Schedule(&ScheduledJob{Due: due}); err != ErrSchedulerFull {
+		t.Errorf("Expected: %v Actual: %v", ErrSchedulerFull, err)
+	}
+	s.Close()
+}
+
+func TestDelayScheduler_Cancel(t *testing.T) {
+	var lock sync.Mutex
+	var flushed []*ScheduledJob
+	s := NewDelayScheduler(100, func(jobs []*ScheduledJob) {
+		lock.Lock()
+		flushed = append(flushed, jobs...)
+		lock.Unlock()
+	})
+	s.Start()
+	ids := make([]*jumphasher.UUID, 3)
+	for i := range ids {
+		ids[i], _ = jumphasher.UUIDv4()
+		s.Schedule(&ScheduledJob{ID: *ids[i], Due: time.Now().Add(time.Duration(20*(i+1)) * time.Millisecond)})
+	}
+	if !s.Cancel(ids[1]) {
+		t.Fatal("Waiting job could not be cancelled")
+	}
+	if s.Cancel(ids[1]) {
+		t.Error("Job cancelled twice")
+	}
+	s.Close()
+	if len(flushed) != 2 || flushed[0].ID != *ids[0] || flushed[1].ID != *ids[2] {
+		t.Errorf("Cancelled job was flushed or others were lost: %v", flushed)
+	}
+	if s.Cancel(ids[0]) {
+		t.Error("Flushed job was cancelled")
+	}
+}
+
+func TestDelayScheduler_Abandon(t *testing.T) {
+	flushed := 0
+	s := NewDelayScheduler(100, func(jobs []*ScheduledJob) { flushed += len(jobs) })
+	s.Start()
+	for i := 0; i < 3; i++ {
+		s.Schedule(&ScheduledJob{Due: time.Now().Add(time.Hour)})
+	}
+	if n := s.Abandon(); n != 3 {
+		t.Errorf("Expected abandoned: %d Actual: %d", 3, n)
+	}
+	if flushed != 0 {
+		t.Errorf("Abandoned jobs were flushed")
+	}
+	if err := s.Schedule(&ScheduledJob{}); err != ErrSchedulerClosed {
+		t.Errorf("Expected: %v Actual: %v", ErrSchedulerClosed, err)
+	}
+}
+
+func TestDelayScheduler_Flush(t *testing.T) {
+	flushed := 0
+	s := NewDelayScheduler(100, func(jobs []*ScheduledJob) { flushed += len(jobs) })
+	s.Start()
+	for i := 0; i < 3; i++ {
+		s.Schedule(&ScheduledJob{Due: time.Now().Add(time.Hour)})
+	}
+	start := time.Now()
+	s.Flush()
+	if time.Since(start) > time.Second {
+		t.Error("Flush waited for jobs to come due")
+	}
+	if flushed != 3 || s.Len() != 0 {
+		t.Errorf("Expected flushed: %d Actual: %d (%d still waiting)", 3, flushed, s.Len())
+	}
+	if err := s.Schedule(&ScheduledJob{}); err != ErrSchedulerClosed {
+		t.Errorf("Expected: %v Actual: %v", ErrSchedulerClosed, err)
+	}
+}
+
+func TestDelayScheduler_Batching(t *testing.T) {
+	var lock sync.Mutex
+	sizes := []int{}
+	s := NewDelayScheduler(10000, func(jobs []*ScheduledJob) {
+		lock.Lock()
+		sizes = append(sizes, len(jobs))
+		lock.Unlock()
+	})
+	s.Start()
+	due := time.Now().Add(20 * time.Millisecond)
+	for i := 0; i < 2*schedulerMaxBatch+1; i++ {
+		s.Schedule(&ScheduledJob{Due: due})
+	}
+	s.Close()
+	if len(sizes) != 3 || sizes[0] != schedulerMaxBatch || sizes[2] != 1 {
+		t.Errorf("Unexpected batch sizes: %v", sizes)
+	}
+}
+
+const benchmarkJobDelay = 10 * time.Millisecond
+
+//Schedules b.N delayed jobs through the heap scheduler and waits for them all to be flushed
+func BenchmarkDelayScheduler(b *testing.B) {
+	b.ReportAllocs()
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+	s := NewDelayScheduler(b.N+1, func(jobs []*ScheduledJob) {
+		for range jobs {
+			wg.Done()
+		}
+	})
+	s.Start()
+	for i := 0; i < b.N; i++ {
+		s.Schedule(&ScheduledJob{Due: time.Now().Add(benchmarkJobDelay)})
+	}
+	wg.Wait()
+	s.Close()
+}
+
+//The approach DelayScheduler replaced: one sleeping goroutine per job
+func BenchmarkGoroutinePerJob(b *testing.B) {
+	b.ReportAllocs()
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+	flush := func(jobs []*ScheduledJob) {
+		for range jobs {
+			wg.Done()
+		}
+	}
+	for i := 0; i < b.N; i++ {
+		j := &ScheduledJob{Due: time.Now().Add(benchmarkJobDelay)}
+		go func() {
+			time.Sleep(benchmarkJobDelay)
+			flush([]*ScheduledJob{j})
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"github.com/iamthebot/jumphasher/common"
+	"io"
+	"strings"
+)
+
+//Opens the hash store described by spec
+//
+//spec is either 'mem' for an in-memory store or 'file:<path>' for a durable append-only log at path
+//
+//c: Desired concurrency, used to size the in-memory index
+//
+//keyfile: If not empty, hashes are sealed at rest using the keys in this file
+func OpenHashStore(spec string, c int, keyfile string) (jumphasher.HashStore, error) {
+	var s jumphasher.HashStore
+	switch {
+	case spec == "mem":
+		s = jumphasher.NewMemHashStore(c)
+	case strings.HasPrefix(spec, "file:") && len(spec) > len("file:"):
+		fs, err := jumphasher.OpenFileHashStore(strings.TrimPrefix(spec, "file:"), c)
+		if err != nil {
+			return nil, err
+		}
+		s = fs
+	default:
+		return nil, fmt.Errorf("unknown store '%s'. Expected 'mem' or 'file:<path>'", spec)
+	}
+	if keyfile != "" {
+		keys, err := jumphasher.LoadKeyring(keyfile)
+		if err != nil {
+			CloseHashStore(s)
+			return nil, err
+		}
+		s = jumphasher.NewEncryptedHashStore(s, keys)
+	}
+	return s, nil
+}
+
+//Closes a hash store if its backend holds resources that need releasing
+func CloseHashStore(s jumphasher.HashStore) error {
+	if c, ok := s.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+//Finds the resizable store behind any decorators, if there is one
+func resizableStore(s jumphasher.HashStore) (jumphasher.ResizableHashStore, bool) {
+	for s != nil {
+		if r, ok := s.(jumphasher.ResizableHashStore); ok {
+			return r, true
+		}
+		w, ok := s.(interface {
+			Unwrap() jumphasher.HashStore
+		})
+		if !ok {
+			break
+		}
+		s = w.Unwrap()
+	}
+	return nil, false
+}
+
+//Finds the keyring hashes are sealed with behind any decorators, or nil if they're stored in the clear
+func storeKeyring(s jumphasher.HashStore) *jumphasher.Keyring {
+	for s != nil {
+		if e, ok := s.(*jumphasher.EncryptedHashStore); ok {
+			return e.Keyring()
+		}
+		w, ok := s.(interface {
+			Unwrap() jumphasher.HashStore
+		})
+		if !ok {
+			break
+		}
+		s = w.Unwrap()
+	}
+	return nil
+}
+
+//Flushes a hash store to stable storage if its backend (or the one behind any decorators) supports it
+func SyncHashStore(s jumphasher.HashStore) error {
+	for s != nil {
+		if sy, ok := s.(interface {
+			Sync() error
+		}); ok {
+			return sy.Sync()
+		}
+		w, ok := s.(interface {
+			Unwrap() jumphasher.HashStore
+		})
+		if !ok {
+			break
+		}
+		s = w.Unwrap()
+	}
+	return nil
+}
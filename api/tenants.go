@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/iamthebot/jumphasher/common"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Header clients send their API key in. 'Authorization: Bearer <key>' is accepted too
+const APIKeyHeader = "X-API-Key"
+
+//How often the API keys file is checked for changes
+const apiKeysReloadInterval = 5 * time.Second
+
+//Shortest API key we'll accept, so keys can't be guessed
+const minAPIKeyLength = 16
+
+//Shortest tenant secret we'll accept, so the keys job IDs are mapped under can't be guessed
+const minTenantSecretLength = 16
+
+var tenantNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+var ErrNoAPIKeys error = errors.New("API keys file holds no keys")
+
+var ErrWeakTenantSecret error = errors.New("tenant secret must be at least 16 bytes")
+
+//A team sharing the deployment
+//
+//Every job ID a tenant sees is mapped into its own namespace before it reaches the store, scheduler or journal,
+//so the same ID refers to different jobs for different tenants and one tenant can't read another's hashes even
+//with a guessed ID. A nil Tenant is the default tenant used when API keys are disabled, whose IDs aren't mapped
+//
+//IDs are mapped by encrypting them with AES under a key derived from the tenant name and a server secret. Without
+//the secret, no tenant can work out which of its own IDs lands on another tenant's job
+type Tenant struct {
+	Name     string
+	Priority Priority     //priority class for requests without an X-Priority header, and the highest one they may ask for
+	ns       cipher.Block //maps client job IDs to stored job IDs and back
+	keyID    string       //identifies the API key the tenant was looked up by, without revealing it
+}
+
+//Creates a tenant with the given default priority class
+//
+//secret: Server secret job IDs are mapped under. It must stay the same across restarts, or stored jobs are orphaned
+func NewTenant(name string, p Priority, secret []byte) *Tenant {
+	t := &Tenant{Name: name, Priority: p}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("jumphasher tenant\x00" + name))
+	t.ns, _ = aes.NewCipher(mac.Sum(nil)) //can't fail with a 32 byte key
+	return t
+}
+
+//Maps a job ID as the tenant sees it to the ID it's stored under
+func (t *Tenant) JobKey(id *jumphasher.UUID) jumphasher.UUID {
+	k := *id
+	if t != nil {
+		t.ns.Encrypt(k[:], id[:])
+	}
+	return k
+}
+
+//Maps a stored job ID back to the ID the tenant sees. The inverse of JobKey
+func (t *Tenant) ClientID(key *jumphasher.UUID) jumphasher.UUID {
+	id := *key
+	if t != nil {
+		t.ns.Decrypt(id[:], key[:])
+	}
+	return id
+}
+
+//Name of t, or the empty string for the default tenant
+func tenantName(t *Tenant) string {
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
+
+//Priority class for requests from t that don't ask for one
+func tenantPriority(t *Tenant) Priority {
+	if t == nil {
+		return PriorityNormal
+	}
+	return t.Priority
+}
+
+//Highest priority class requests from t may ask for. The default tenant isn't identified by a key, so isn't capped
+func tenantMaxPriority(t *Tenant) Priority {
+	if t == nil {
+		return PriorityInteractive
+	}
+	return t.Priority
+}
+
+//API keys loaded from a file, reloaded whenever the file changes
+//
+//Each non-empty line not starting with '#' is '<key>:<tenant>[:<default priority>]'. Several keys may belong to the
+//same tenant, so keys can be rotated without moving jobs. Keys are only held as SHA-256 digests
+type APIKeys struct {
+	path    string
+	secret  []byte       //tenant secret job IDs are mapped under
+	keys    atomic.Value //*apiKeySet
+	modTime time.Time
+	size    int64
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+//Loads the API keys in path and starts watching it for changes
+//
+//secret: Server secret the tenants' job IDs are mapped under. See NewTenant
+func LoadAPIKeys(path string, secret []byte) (*APIKeys, error) {
+	if len(secret) < minTenantSecretLength {
+		return nil, ErrWeakTenantSecret
+	}
+	var k APIKeys
+	k.path = path
+	k.secret = secret
+	k.stop = make(chan struct{})
+	if _, err := k.reload(); err != nil {
+		return nil, err
+	}
+	k.wg.Add(1)
+	go k.watch(apiKeysReloadInterval)
+	return &k, nil
+}
+
+//Contents of an API keys file
+type apiKeySet struct {
+	digests map[[sha256.Size]byte]*Tenant
+	tenants map[string]*Tenant //by name. The first key listed for a tenant decides its default priority
+}
+
+func parseAPIKeys(path string, secret []byte) (*apiKeySet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := &apiKeySet{digests: make(map[[sha256.Size]byte]*Tenant), tenants: make(map[string]*Tenant)}
+	s := bufio.NewScanner(f)
+	lineNo := 0
+	for s.Scan() {
+		lineNo++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("API keys file %s line %d: expected <key>:<tenant>[:<priority>]", path, lineNo)
+		}
+		key, name := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if len(key) < minAPIKeyLength {
+			return nil, fmt.Errorf("API keys file %s line %d: keys must be at least %d characters", path, lineNo, minAPIKeyLength)
+		}
+		if !tenantNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("API keys file %s line %d: tenant names may only contain letters, digits, '.', '_' and '-'", path, lineNo)
+		}
+		p := PriorityNormal
+		if len(parts) == 3 {
+			if p, err = ParsePriority(strings.TrimSpace(parts[2])); err != nil {
+				return nil, fmt.Errorf("API keys file %s line %d: %s", path, lineNo, err.Error())
+			}
+		}
+		digest := sha256.Sum256([]byte(key))
+		if _, exists := keys.digests[digest]; exists {
+			return nil, fmt.Errorf("API keys file %s line %d: duplicate key", path, lineNo)
+		}
+		t := NewTenant(name, p, secret)
+		t.keyID = hex.EncodeToString(digest[:6])
+		keys.digests[digest] = t
+		if _, exists := keys.tenants[name]; !exists {
+			keys.tenants[name] = NewTenant(name, p, secret)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys.digests) == 0 {
+		return nil, ErrNoAPIKeys
+	}
+	return keys, nil
+}
+
+//Re-reads the keys file if it changed since it was last loaded. Returns whether it was reloaded
+//
+//If the file can't be parsed, the keys already loaded stay in effect
+func (k *APIKeys) reload() (bool, error) {
+	fi, err := os.Stat(k.path)
+	if err != nil {
+		return false, err
+	}
+	if fi.ModTime().Equal(k.modTime) && fi.Size() == k.size {
+		return false, nil
+	}
+	keys, err := parseAPIKeys(k.path, k.secret)
+	if err != nil {
+		return false, err
+	}
+	k.keys.Store(keys)
+	k.modTime, k.size = fi.ModTime(), fi.Size()
+	return true, nil
+}
+
+func (k *APIKeys) watch(interval time.Duration) {
+	defer k.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if reloaded, err := k.reload(); err != nil {
+				log.Printf("Error: could not reload API keys, keeping the previous ones: %s", err.Error())
+			} else if reloaded {
+				infof("Reloaded API keys from %s", k.path)
+			}
+		case <-k.stop:
+			return
+		}
+	}
+}
+
+//Stops watching the keys file
+func (k *APIKeys) Close() {
+	close(k.stop)
+	k.wg.Wait()
+}
+
+//Returns the tenant key belongs to, or nil if it isn't a valid key
+func (k *APIKeys) Lookup(key string) *Tenant {
+	return k.keys.Load().(*apiKeySet).digests[sha256.Sum256([]byte(key))]
+}
+
+//Returns the tenant with the given name, or nil if no key belongs to it
+func (k *APIKeys) Tenant(name string) *Tenant {
+	return k.keys.Load().(*apiKeySet).tenants[name]
+}
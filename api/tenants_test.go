@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"github.com/iamthebot/jumphasher/common"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testKeyA = "team-a-key-0123456789"
+	testKeyB = "team-b-key-0123456789"
+)
+
+var testTenantSecret = []byte("tenant-secret-0123456789")
+
+//The ID tenant 'to' would have to present to reach tenant 'from's job id if namespaces were XOR masks derived
+//from tenant names alone, as they once were
+func forgeJobID(id *jumphasher.UUID, from, to string) jumphasher.UUID {
+	nsFrom := sha256.Sum256([]byte("jumphasher tenant\x00" + from))
+	nsTo := sha256.Sum256([]byte("jumphasher tenant\x00" + to))
+	forged := *id
+	for i := range forged {
+		forged[i] ^= nsFrom[i] ^ nsTo[i]
+	}
+	return forged
+}
+
+func writeAPIKeys(t *testing.T, path string, lines ...string) {
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jumphasher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "apikeys")
+	writeAPIKeys(t, path, "# comment", testKeyA+":team-a", testKeyB+":team-b:bulk")
+	k, err := LoadAPIKeys(path, testTenantSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	if a := k.Lookup(testKeyA); a == nil || a.Name != "team-a" || a.Priority != PriorityNormal {
+		t.Errorf("Unexpected tenant for key A: %+v", a)
+	}
+	if b := k.Lookup(testKeyB); b == nil || b.Name != "team-b" || b.Priority != PriorityBulk {
+		t.Errorf("Unexpected tenant for key B: %+v", b)
+	}
+	if k.Lookup("") != nil || k.Lookup("team-c-key-0123456789") != nil {
+		t.Error("Unknown key was accepted")
+	}
+
+	//a broken file keeps the old keys in effect, and a fixed one replaces them
+	writeAPIKeys(t, path, "short:team-a")
+	if _, err := k.reload(); err == nil {
+		t.Error("Expected error for short key")
+	}
+	if k.Lookup(testKeyA) == nil {
+		t.Error("Keys lost after failed reload")
+	}
+	writeAPIKeys(t, path, testKeyB+":team-b")
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if reloaded, err := k.reload(); err != nil || !reloaded {
+		t.Fatalf("Expected reload. Actual: %v (%v)", reloaded, err)
+	}
+	if k.Lookup(testKeyA) != nil || k.Lookup(testKeyB) == nil {
+		t.Error("Reload didn't replace keys")
+	}
+
+	for _, bad := range [][]string{{"# empty"}, {testKeyA + ":team a"}, {testKeyA + ":team-a:urgent"}, {testKeyA + ":team-a", testKeyA + ":team-b"}} {
+		writeAPIKeys(t, path, bad...)
+		if _, err := parseAPIKeys(path, testTenantSecret); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+func TestTenant_JobKey(t *testing.T) {
+	u, _ := jumphasher.UUIDv4()
+	a, b := NewTenant("team-a", PriorityNormal, testTenantSecret), NewTenant("team-b", PriorityNormal, testTenantSecret)
+	ka, kb := a.JobKey(u), b.JobKey(u)
+	if ka == kb || ka == *u {
+		t.Error("Tenants share a namespace")
+	}
+	if id := a.ClientID(&ka); id != *u {
+		t.Errorf("Expected client ID: %s Actual: %s", u.MarshalText(), id.MarshalText())
+	}
+	var none *Tenant
+	if none.JobKey(u) != *u || none.ClientID(u) != *u {
+		t.Error("Default tenant IDs must not be mapped")
+	}
+
+	//the mapping depends on the server secret, not just the tenant name
+	if NewTenant("team-a", PriorityNormal, []byte("another-secret-0123456789")).JobKey(u) == ka {
+		t.Error("Tenant namespace doesn't depend on the server secret")
+	}
+	forged := forgeJobID(u, "team-a", "team-b")
+	if b.JobKey(&forged) == ka {
+		t.Error("Tenant namespace can be forged from tenant names")
+	}
+	if _, err := LoadAPIKeys("unused", []byte("short")); err != ErrWeakTenantSecret {
+		t.Errorf("Expected: %v Actual: %v", ErrWeakTenantSecret, err)
+	}
+	if _, err := NewAPIEngine(EngineConfig{Concurrency: 1, APIKeys: &APIKeys{}}); err != ErrWeakTenantSecret {
+		t.Errorf("Expected: %v Actual: %v", ErrWeakTenantSecret, err)
+	}
+}
+
+//One tenant can't read, wait on or cancel another tenant's jobs, and keys set the default priority
+func TestAPIEngine_tenantIsolation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jumphasher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "apikeys")
+	writeAPIKeys(t, path, testKeyA+":team-a:interactive", testKeyB+":team-b")
+	keys, err := LoadAPIKeys(path, testTenantSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEngine(t, EngineConfig{APIKeys: keys, TenantSecret: testTenantSecret})
+	e.alive.TestAndSet()
+	e.startWorkers()
+	defer e.Stop()
+	h := e.Handler()
+	do := func(method, target, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("POST", "/hash?delay=0", "", "hunter2"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status: %d Actual: %d", http.StatusUnauthorized, w.Code)
+	}
+	w := do("POST", "/hash?delay=0", testKeyA, "hunter2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status: %d Actual: %d", http.StatusOK, w.Code)
+	}
+	id := w.Body.String()
+	if w := do("GET", "/hash?id="+id, testKeyA, ""); w.Code != http.StatusOK {
+		t.Errorf("Owner: Expected status: %d Actual: %d", http.StatusOK, w.Code)
+	}
+	if w := do("GET", "/hash?id="+id+"&wait=10ms", testKeyB, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Other tenant: Expected status: %d Actual: %d", http.StatusNotFound, w.Code)
+	}
+	var u jumphasher.UUID
+	u.UnmarshalText(id)
+	forged := forgeJobID(&u, "team-a", "team-b")
+	if w := do("GET", "/hash?id="+forged.MarshalText(), testKeyB, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Forged ID: Expected status: %d Actual: %d", http.StatusNotFound, w.Code)
+	}
+	if served := atomic.LoadInt64(&e.classes[PriorityInteractive].served); served != 1 {
+		t.Errorf("Expected interactive requests served: %d Actual: %d", 1, served)
+	}
+
+	w = do("POST", "/hash?delay=1h", testKeyA, "hunter2")
+	id = w.Body.String()
+	if w := do("POST", "/jobs/"+id+"/cancel", testKeyB, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Other tenant cancel: Expected status: %d Actual: %d", http.StatusNotFound, w.Code)
+	}
+	if w := do("POST", "/jobs/"+id+"/cancel", testKeyA, ""); w.Code != http.StatusOK {
+		t.Errorf("Owner cancel: Expected status: %d Actual: %d", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/iamthebot/jumphasher/common"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//Header carrying the hex encoded HMAC-SHA256 of the request body, prefixed with 'sha256='
+const WebhookSignatureHeader = "X-Jumphasher-Signature"
+
+//Defaults for webhook delivery
+const (
+	DefaultWebhookAttempts    = 5
+	DefaultWebhookConcurrency = 4
+	DefaultWebhookDeadLetters = 1000
+)
+
+//First retry waits this long. Each subsequent retry doubles it up to webhookMaxBackoff
+const webhookBaseBackoff = time.Second
+const webhookMaxBackoff = 5 * time.Minute
+
+//How long to wait before retrying a delivery whose destination is at its concurrency limit
+const webhookBusyBackoff = 50 * time.Millisecond
+
+//number of goroutines making webhook requests
+const webhookWorkers = 8
+
+var ErrInvalidCallbackURL error = errors.New("callback_url must be an absolute http or https URL")
+var ErrCallbackAddressBlocked error = errors.New("callback_url must not point at a loopback, link-local or private address")
+var ErrWebhooksClosed error = errors.New("webhook dispatcher is shutting down")
+
+//Special purpose ranges not covered by net.IP's own checks that callbacks may not reach either
+var blockedCallbackNets = mustParseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4")
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+//Body POSTed to a callback URL once a hash is available
+type WebhookPayload struct {
+	ID          string    `json:"id"`
+	Hash        string    `json:"hash"` //base 64 encoded, same as GET /hash
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+//A webhook that exhausted its retries
+type DeadLetter struct {
+	ID          string    `json:"id"` //as the job's tenant sees it
+	Tenant      string    `json:"tenant,omitempty"`
+	CallbackURL string    `json:"callback_url"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error"`
+	FailedAt    time.Time `json:"failed_at"`
+}
+
+//A pending webhook delivery
+type webhook struct {
+	url      string
+	host     string
+	body     []byte
+	id       string
+	tenant   string
+	attempts int
+}
+
+//Delivers signed webhooks to callback URLs
+//
+//A fixed pool of workers makes the requests. Failed deliveries are retried with exponential backoff
+//using timers rather than sleeping goroutines, and at most perHost requests are in flight to any one destination
+//at a time. Deliveries that exhaust their attempts end up in a bounded dead-letter list
+//
+//Callbacks are only ever made to public addresses, unless allowed explicitly. The check runs when connecting,
+//after DNS resolution, so a name that resolves to a private address (or is rebound to one) is refused too
+type WebhookDispatcher struct {
+	secret      []byte
+	client      *http.Client
+	attempts    int
+	perHost     int
+	allow       []*net.IPNet //non-public networks callbacks may reach anyway
+	baseBackoff time.Duration
+	queue       chan *webhook
+	inflight    map[string]int //requests in flight per destination host
+	dead        []DeadLetter   //ring buffer of dead letters
+	deadNext    int            //next slot to overwrite in dead once it's full
+	lock        sync.Mutex     //guards inflight and dead
+	closing     bool           //set by Close. Guarded by queueLock
+	queueLock   sync.RWMutex   //held for reading while sending on queue, and for writing to close it
+	wg          sync.WaitGroup
+}
+
+//Creates a new WebhookDispatcher and starts its workers
+//
+//secret: HMAC key used to sign payloads
+//
+//attempts: Delivery attempts before a webhook is dead-lettered
+//
+//perHost: Maximum concurrent requests to a single destination
+//
+//deadLetters: Number of dead letters to remember
+//
+//allow: Loopback, link-local or private networks callbacks may reach. Others are refused
+func NewWebhookDispatcher(secret []byte, attempts int, perHost int, deadLetters int, allow []*net.IPNet) *WebhookDispatcher {
+	var d WebhookDispatcher
+	d.secret = secret
+	d.allow = allow
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: d.dialControl}
+	d.client = &http.Client{
+		Timeout: 10 * time.Second,
+		//no proxy, since it would make the connection on our behalf to wherever the callback points
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+	}
+	d.attempts = attempts
+	d.perHost = perHost
+	d.baseBackoff = webhookBaseBackoff
+	d.queue = make(chan *webhook, 1024)
+	d.inflight = make(map[string]int)
+	d.dead = make([]DeadLetter, 0, deadLetters)
+	for i := 0; i < webhookWorkers; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	return &d
+}
+
+//Checks that a callback URL is something we're willing to POST to
+//
+//Hosts given as IP addresses are checked straight away. Names are checked once resolved, by dialControl
+func (d *WebhookDispatcher) ValidateCallbackURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrInvalidCallbackURL
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !d.callbackAllowed(ip) {
+		return nil, ErrCallbackAddressBlocked
+	}
+	return u, nil
+}
+
+//Whether callbacks may connect to ip
+func (d *WebhookDispatcher) callbackAllowed(ip net.IP) bool {
+	for _, n := range d.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range blockedCallbackNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+//Refuses connections to addresses callbacks may not reach. Runs for every connection, redirects included
+func (d *WebhookDispatcher) dialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !d.callbackAllowed(ip) {
+		return fmt.Errorf("%s: %s", ErrCallbackAddressBlocked.Error(), host)
+	}
+	return nil
+}
+
+//Signs body with the dispatcher's secret
+func (d *WebhookDispatcher) Sign(body []byte) string {
+	m := hmac.New(sha256.New, d.secret)
+	m.Write(body)
+	return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
+
+//Queues a webhook announcing that the hash for id is available
+//
+//id is the job ID as stored. The payload carries it as t sees it
+func (d *WebhookDispatcher) Enqueue(callbackURL string, t *Tenant, id *jumphasher.UUID, hash []byte) error {
+	u, err := d.ValidateCallbackURL(callbackURL)
+	if err != nil {
+		return err
+	}
+	clientID := t.ClientID(id)
+	strid := clientID.MarshalText()
+	body, err := json.Marshal(WebhookPayload{
+		ID:          strid,
+		Hash:        base64.StdEncoding.EncodeToString(hash),
+		CompletedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return d.send(&webhook{url: callbackURL, host: u.Host, body: body, id: strid, tenant: tenantName(t)})
+}
+
+//Queues w unless the dispatcher is closing
+func (d *WebhookDispatcher) send(w *webhook) error {
+	d.queueLock.RLock()
+	defer d.queueLock.RUnlock()
+	if d.closing {
+		return ErrWebhooksClosed
+	}
+	d.queue <- w
+	return nil
+}
+
+//Stops the workers once the queue drains. Retries still waiting on their backoff are dropped
+func (d *WebhookDispatcher) Close() {
+	//the workers keep draining the queue, so senders blocked on a full queue get through and release the lock
+	d.queueLock.Lock()
+	d.closing = true
+	close(d.queue)
+	d.queueLock.Unlock()
+	d.wg.Wait()
+}
+
+//Re-queues a webhook after a delay without tying up a goroutine in the meantime
+func (d *WebhookDispatcher) retryAfter(w *webhook, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		if err := d.send(w); err != nil {
+			log.Printf("Error: dropped webhook for job %s to %s during shutdown", w.id, w.url)
+		}
+	})
+}
+
+func (d *WebhookDispatcher) worker() {
+	defer d.wg.Done()
+	for w := range d.queue {
+		//respect the per-destination limit
+		d.lock.Lock()
+		if d.inflight[w.host] >= d.perHost {
+			d.lock.Unlock()
+			d.retryAfter(w, webhookBusyBackoff)
+			continue
+		}
+		d.inflight[w.host]++
+		d.lock.Unlock()
+
+		err := d.deliver(w)
+
+		d.lock.Lock()
+		if d.inflight[w.host]--; d.inflight[w.host] == 0 {
+			delete(d.inflight, w.host)
+		}
+		d.lock.Unlock()
+
+		if err == nil {
+			continue
+		}
+		w.attempts++
+		if w.attempts >= d.attempts {
+			log.Printf("Error: webhook for job %s to %s failed after %d attempts: %s", w.id, w.url, w.attempts, err.Error())
+			d.addDeadLetter(w, err)
+			continue
+		}
+		backoff := d.baseBackoff << uint(w.attempts-1)
+		if backoff > webhookMaxBackoff || backoff <= 0 {
+			backoff = webhookMaxBackoff
+		}
+		debugf("Retrying webhook for job %s to %s in %s: %s", w.id, w.url, backoff, err.Error())
+		d.retryAfter(w, backoff)
+	}
+}
+
+//Makes a single delivery attempt. Any non-2xx response counts as a failure
+func (d *WebhookDispatcher) deliver(w *webhook) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(w.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, d.Sign(w.body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (d *WebhookDispatcher) addDeadLetter(w *webhook, err error) {
+	dl := DeadLetter{
+		ID:          w.id,
+		Tenant:      w.tenant,
+		CallbackURL: w.url,
+		Attempts:    w.attempts,
+		LastError:   err.Error(),
+		FailedAt:    time.Now().UTC(),
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if cap(d.dead) == 0 {
+		return
+	}
+	if len(d.dead) < cap(d.dead) {
+		d.dead = append(d.dead, dl)
+		return
+	}
+	d.dead[d.deadNext] = dl
+	d.deadNext = (d.deadNext + 1) % len(d.dead)
+}
+
+//Returns the dead letters remembered, oldest first
+func (d *WebhookDispatcher) DeadLetters() []DeadLetter {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	out := make([]DeadLetter, 0, len(d.dead))
+	for i := range d.dead {
+		out = append(out, d.dead[(d.deadNext+i)%len(d.dead)])
+	}
+	return out
+}
+
+//route handler for POST /admin/webhooks/deadletters
+//
+//Lists the dead letters, only those for the tenant named by the 'tenant' parameter if given
+func (e *APIEngine) onAdminDeadLettersPost(w http.ResponseWriter, req *http.Request) {
+	if e.webhooks == nil {
+		http.Error(w, "webhooks are disabled", http.StatusNotFound)
+		return
+	}
+	dead := e.webhooks.DeadLetters()
+	if name := req.URL.Query().Get("tenant"); name != "" {
+		filtered := make([]DeadLetter, 0, len(dead))
+		for _, dl := range dead {
+			if dl.Tenant == name {
+				filtered = append(filtered, dl)
+			}
+		}
+		dead = filtered
+	}
+	writeAdminJSON(w, dead)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"github.com/iamthebot/jumphasher/common"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//httptest servers listen on loopback, which callbacks may only reach when allowed
+var testLoopback = mustParseCIDRs("127.0.0.0/8", "::1/128")
+
+func TestWebhookDispatcher_Deliver(t *testing.T) {
+	var calls int32
+	received := make(chan WebhookPayload, 1)
+	d := NewWebhookDispatcher([]byte("s3cret"), 5, 1, 10, testLoopback)
+	d.baseBackoff = 10 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		//fail the first two attempts
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if !hmac.Equal([]byte(req.Header.Get(WebhookSignatureHeader)), []byte(d.Sign(body))) {
+			t.Error("Webhook signature does not match body")
+		}
+		var p WebhookPayload
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Error(err)
+		}
+		received <- p
+	}))
+	defer srv.Close()
+
+	u, _ := jumphasher.UUIDv4()
+	if err := d.Enqueue(srv.URL, nil, u, []byte("hash")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-received:
+		if p.ID != u.MarshalText() || p.Hash != "aGFzaA==" {
+			t.Errorf("Unexpected payload: %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook was never delivered")
+	}
+	d.Close()
+	if n := len(d.DeadLetters()); n != 0 {
+		t.Errorf("Expected dead letters: %d Actual: %d", 0, n)
+	}
+
+	if err := d.Enqueue("ftp://example.com", nil, u, nil); err != ErrInvalidCallbackURL {
+		t.Errorf("Expected: %v Actual: %v", ErrInvalidCallbackURL, err)
+	}
+	if err := d.Enqueue(srv.URL, nil, u, nil); err != ErrWebhooksClosed {
+		t.Errorf("Expected: %v Actual: %v", ErrWebhooksClosed, err)
+	}
+}
+
+func TestWebhookDispatcher_BlockedAddresses(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer srv.Close()
+	d := NewWebhookDispatcher([]byte("s3cret"), 1, 1, 10, nil)
+	defer d.Close()
+	u, _ := jumphasher.UUIDv4()
+	for _, raw := range []string{srv.URL, "http://10.1.2.3/hook", "http://169.254.169.254/latest/meta-data", "http://[::1]/hook", "http://100.64.0.1/hook"} {
+		if _, err := d.ValidateCallbackURL(raw); err != ErrCallbackAddressBlocked {
+			t.Errorf("%s: Expected: %v Actual: %v", raw, ErrCallbackAddressBlocked, err)
+		}
+	}
+	if _, err := d.ValidateCallbackURL("https://93.184.216.34/hook"); err != nil {
+		t.Errorf("Public address refused: %v", err)
+	}
+
+	//names are checked once resolved, so they can't be used to get around the check
+	hostURL := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	if err := d.Enqueue(hostURL, nil, u, []byte("hash")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(d.DeadLetters()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dl := d.DeadLetters(); len(dl) != 1 || !strings.Contains(dl[0].LastError, ErrCallbackAddressBlocked.Error()) {
+		t.Errorf("Expected a dead letter for the blocked address. Actual: %+v", dl)
+	}
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Error("Callback reached a loopback address")
+	}
+}
+
+func TestWebhookDispatcher_DeadLetters(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	defer srv.Close()
+	d := NewWebhookDispatcher([]byte("s3cret"), 3, 4, 2, testLoopback)
+	d.baseBackoff = time.Millisecond
+	for i := 0; i < 3; i++ {
+		u, _ := jumphasher.UUIDv4()
+		d.Enqueue(srv.URL, nil, u, []byte("hash"))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		d.lock.Lock()
+		n := len(d.dead)
+		d.lock.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	//give the third one a chance to overwrite the oldest
+	time.Sleep(100 * time.Millisecond)
+	dl := d.DeadLetters()
+	if len(dl) != 2 {
+		t.Fatalf("Expected dead letters: %d Actual: %d", 2, len(dl))
+	}
+	for _, l := range dl {
+		if l.Attempts != 3 || l.CallbackURL != srv.URL {
+			t.Errorf("Unexpected dead letter: %+v", l)
+		}
+	}
+	d.Close()
+}
+
+func TestWebhookDispatcher_PerHostConcurrency(t *testing.T) {
+	var cur, peak int32
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&cur, 1)
+		mu.Lock()
+		if n > peak {
+			peak = n
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&cur, -1)
+	}))
+	defer srv.Close()
+	d := NewWebhookDispatcher([]byte("s3cret"), 1, 2, 10, testLoopback)
+	for i := 0; i < 20; i++ {
+		u, _ := jumphasher.UUIDv4()
+		d.Enqueue(srv.URL, nil, u, []byte("hash"))
+	}
+	//wait for everything to be delivered
+	time.Sleep(time.Second)
+	d.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if peak > 2 {
+		t.Errorf("Expected at most %d concurrent requests per host, saw %d", 2, peak)
+	}
+}
+
+func TestAPIEngine_onAdminDeadLettersPost(t *testing.T) {
+	e := newTestEngine(t, EngineConfig{
+		Admin:    &AdminConfig{Addr: ":0", Token: []byte("s3cret")},
+		Webhooks: &WebhookConfig{Secret: []byte("s3cret"), Attempts: 1, Concurrency: 1, DeadLetters: 10},
+	})
+	defer e.webhooks.Close()
+	failed := errors.New("callback responded with status 500")
+	e.webhooks.addDeadLetter(&webhook{url: "https://a.example.com/hook", id: "a", tenant: "team-a", attempts: 1}, failed)
+	e.webhooks.addDeadLetter(&webhook{url: "https://b.example.com/hook", id: "b", tenant: "team-b", attempts: 1}, failed)
+
+	//callback URLs and job IDs are only for operators
+	w := httptest.NewRecorder()
+	e.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/webhooks/deadletters", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected public status: %d Actual: %d", http.StatusNotFound, w.Code)
+	}
+	for _, c := range []struct {
+		target string
+		ids    []string
+	}{
+		{"/admin/webhooks/deadletters", []string{"a", "b"}},
+		{"/admin/webhooks/deadletters?tenant=team-b", []string{"b"}},
+	} {
+		w = httptest.NewRecorder()
+		e.adminSrv.Handler.ServeHTTP(w, newAdminRequest("POST", c.target, "s3cret"))
+		var dl []DeadLetter
+		if err := json.Unmarshal(w.Body.Bytes(), &dl); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, l := range dl {
+			ids = append(ids, l.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(c.ids, ",") {
+			t.Errorf("%s: Expected: %v Actual: %v", c.target, c.ids, ids)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package jumphasher
+
+//Versioned, checksummed dump format used to back up and migrate the contents of a HashStore
+//
+//Two encodings are supported:
+//
+//JSON lines: a header object, one {"id","hash"} object per record, and a trailer object
+//holding the record count and checksum.
+//
+//Binary: the magic "JHDUMP" and a version byte, then per record a 'R' tag, the 16 byte job ID,
+//a uvarint hash length and the hash, and finally an 'E' tag, the record count (uint64, little endian)
+//and the checksum.
+//
+//In both cases the checksum is SHA-256 over the concatenation of job ID and hash of every record in order.
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+const (
+	DumpFormatJSON = iota
+	DumpFormatBinary
+)
+
+//Current dump format version. Readers reject anything newer
+const DumpVersion = 1
+
+const dumpMagic = "JHDUMP"
+const dumpJSONFormatName = "jumphasher-dump"
+
+const (
+	dumpTagRecord byte = 'R'
+	dumpTagEnd    byte = 'E'
+)
+
+var ErrDumpChecksum error = errors.New("dump checksum mismatch")
+var ErrDumpTruncated error = errors.New("dump is truncated")
+var ErrDumpFormat error = errors.New("unrecognized dump format")
+
+type dumpJSONHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+type dumpJSONRecord struct {
+	ID   string `json:"id,omitempty"`
+	Hash string `json:"hash,omitempty"`
+	//only set on the trailer
+	Count  *uint64 `json:"count,omitempty"`
+	SHA256 string  `json:"sha256,omitempty"`
+}
+
+//Writes records in the dump format
+//
+//Close must be called to write the trailer, otherwise readers will treat the dump as truncated
+type DumpWriter struct {
+	w      *bufio.Writer
+	format int
+	sum    hash.Hash
+	count  uint64
+	enc    *json.Encoder
+}
+
+//Creates a new DumpWriter and writes the dump header to w
+func NewDumpWriter(w io.Writer, format int) (*DumpWriter, error) {
+	var d DumpWriter
+	d.w = bufio.NewWriter(w)
+	d.format = format
+	d.sum = sha256.New()
+	switch format {
+	case DumpFormatJSON:
+		d.enc = json.NewEncoder(d.w)
+		if err := d.enc.Encode(dumpJSONHeader{Format: dumpJSONFormatName, Version: DumpVersion}); err != nil {
+			return nil, err
+		}
+	case DumpFormatBinary:
+		d.w.WriteString(dumpMagic)
+		if err := d.w.WriteByte(DumpVersion); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrDumpFormat
+	}
+	return &d, nil
+}
+
+//Write a single record
+func (d *DumpWriter) Write(id *UUID, h []byte) error {
+	if id == nil {
+		return ErrNilJobID
+	}
+	d.sum.Write(id[:])
+	d.sum.Write(h)
+	d.count++
+	if d.format == DumpFormatJSON {
+		return d.enc.Encode(dumpJSONRecord{ID: id.MarshalText(), Hash: base64.StdEncoding.EncodeToString(h)})
+	}
+	var lenbuf [binary.MaxVarintLen64]byte
+	d.w.WriteByte(dumpTagRecord)
+	d.w.Write(id[:])
+	d.w.Write(lenbuf[:binary.PutUvarint(lenbuf[:], uint64(len(h)))])
+	_, err := d.w.Write(h)
+	return err
+}
+
+//Number of records written so far
+func (d *DumpWriter) Count() uint64 {
+	return d.count
+}
+
+//Write the trailer and flush. Does not close the underlying writer
+func (d *DumpWriter) Close() error {
+	sum := d.sum.Sum(nil)
+	if d.format == DumpFormatJSON {
+		count := d.count
+		if err := d.enc.Encode(dumpJSONRecord{Count: &count, SHA256: hex.EncodeToString(sum)}); err != nil {
+			return err
+		}
+	} else {
+		var cbuf [8]byte
+		binary.LittleEndian.PutUint64(cbuf[:], d.count)
+		d.w.WriteByte(dumpTagEnd)
+		d.w.Write(cbuf[:])
+		d.w.Write(sum)
+	}
+	return d.w.Flush()
+}
+
+//Reads records from a dump, detecting the encoding from the header
+type DumpReader struct {
+	r      *bufio.Reader
+	format int
+	sum    hash.Hash
+	count  uint64
+	done   bool
+}
+
+//Creates a new DumpReader and validates the dump header
+func NewDumpReader(r io.Reader) (*DumpReader, error) {
+	var d DumpReader
+	d.r = bufio.NewReader(r)
+	d.sum = sha256.New()
+	magic, err := d.r.Peek(len(dumpMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(magic, []byte(dumpMagic)) {
+		d.format = DumpFormatBinary
+		d.r.Discard(len(dumpMagic))
+		v, err := d.r.ReadByte()
+		if err != nil {
+			return nil, ErrDumpTruncated
+		}
+		if v > DumpVersion {
+			return nil, fmt.Errorf("unsupported dump version %d", v)
+		}
+		return &d, nil
+	}
+	d.format = DumpFormatJSON
+	line, err := d.r.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, ErrDumpFormat
+	}
+	var hdr dumpJSONHeader
+	if err := json.Unmarshal(line, &hdr); err != nil || hdr.Format != dumpJSONFormatName {
+		return nil, ErrDumpFormat
+	}
+	if hdr.Version > DumpVersion {
+		return nil, fmt.Errorf("unsupported dump version %d", hdr.Version)
+	}
+	return &d, nil
+}
+
+//Encoding of the dump being read
+func (d *DumpReader) Format() int {
+	return d.format
+}
+
+//Reads the next record
+//
+//Returns io.EOF once the trailer has been read and verified.
+//Returns ErrDumpChecksum or ErrDumpTruncated if the dump is corrupt
+func (d *DumpReader) Next() (*UUID, []byte, error) {
+	if d.done {
+		return nil, nil, io.EOF
+	}
+	var id UUID
+	var h []byte
+	var count uint64
+	var sum []byte
+	trailer := false
+	if d.format == DumpFormatJSON {
+		line, err := d.r.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			if err == io.EOF {
+				return nil, nil, ErrDumpTruncated
+			}
+			return nil, nil, err
+		}
+		var rec dumpJSONRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, nil, fmt.Errorf("malformed dump record %d: %s", d.count+1, err.Error())
+		}
+		if rec.Count != nil {
+			trailer = true
+			count = *rec.Count
+			sum, err = hex.DecodeString(rec.SHA256)
+			if err != nil {
+				return nil, nil, ErrDumpChecksum
+			}
+		} else {
+			if err := id.UnmarshalText(rec.ID); err != nil {
+				return nil, nil, err
+			}
+			h, err = base64.StdEncoding.DecodeString(rec.Hash)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	} else {
+		tag, err := d.r.ReadByte()
+		if err != nil {
+			return nil, nil, ErrDumpTruncated
+		}
+		switch tag {
+		case dumpTagRecord:
+			if _, err := io.ReadFull(d.r, id[:]); err != nil {
+				return nil, nil, ErrDumpTruncated
+			}
+			n, err := binary.ReadUvarint(d.r)
+			if err != nil || n > maxFileRecordSize {
+				return nil, nil, ErrDumpTruncated
+			}
+			h = make([]byte, n)
+			if _, err := io.ReadFull(d.r, h); err != nil {
+				return nil, nil, ErrDumpTruncated
+			}
+		case dumpTagEnd:
+			trailer = true
+			var buf [8 + sha256.Size]byte
+			if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+				return nil, nil, ErrDumpTruncated
+			}
+			count = binary.LittleEndian.Uint64(buf[:8])
+			sum = buf[8:]
+		default:
+			return nil, nil, ErrDumpFormat
+		}
+	}
+	if trailer {
+		d.done = true
+		if count != d.count || !bytes.Equal(sum, d.sum.Sum(nil)) {
+			return nil, nil, ErrDumpChecksum
+		}
+		return nil, nil, io.EOF
+	}
+	d.sum.Write(id[:])
+	d.sum.Write(h)
+	d.count++
+	return &id, h, nil
+}
+
+//Streams every record in s to w in the given dump format
+//
+//progress, if not nil, is called with the running record count every progressEvery records and once at the end
+func ExportHashStore(s HashStore, w io.Writer, format int, progressEvery uint64, progress func(n uint64)) (uint64, error) {
+	d, err := NewDumpWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+	err = s.Range(func(id *UUID, h []byte) error {
+		if err := d.Write(id, h); err != nil {
+			return err
+		}
+		if progress != nil && progressEvery > 0 && d.Count()%progressEvery == 0 {
+			progress(d.Count())
+		}
+		return nil
+	})
+	if err != nil {
+		return d.Count(), err
+	}
+	if err := d.Close(); err != nil {
+		return d.Count(), err
+	}
+	if progress != nil {
+		progress(d.Count())
+	}
+	return d.Count(), nil
+}
+
+//Loads every record from a dump in r into s
+//
+//Records are stored as they are read, so a corrupt dump may leave s partially populated.
+//progress behaves as in ExportHashStore
+func ImportHashStore(s HashStore, r io.Reader, progressEvery uint64, progress func(n uint64)) (uint64, error) {
+	d, err := NewDumpReader(r)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for {
+		id, h, err := d.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return n, err
+		}
+		if err := s.Store(id, h); err != nil {
+			return n, err
+		}
+		n++
+		if progress != nil && progressEvery > 0 && n%progressEvery == 0 {
+			progress(n)
+		}
+	}
+	if progress != nil {
+		progress(n)
+	}
+	return n, nil
+}
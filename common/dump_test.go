@@ -0,0 +1,74 @@
+package jumphasher
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testDumpRoundTrip(t *testing.T, format int) {
+	src := NewMemHashStore(4)
+	he := NewSHA512Engine()
+	for i := 0; i < 1000; i++ {
+		u, _ := UUIDv4()
+		h, _ := he.Hash(u[:])
+		src.Store(u, h)
+	}
+	var buf bytes.Buffer
+	var progressCalls int
+	n, err := ExportHashStore(src, &buf, format, 100, func(n uint64) { progressCalls++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Errorf("Expected exported: %d Actual: %d", 1000, n)
+	}
+	if progressCalls != 11 {
+		t.Errorf("Expected progress calls: %d Actual: %d", 11, progressCalls)
+	}
+	dump := buf.Bytes()
+
+	dst := NewMemHashStore(2)
+	n, err = ImportHashStore(dst, bytes.NewReader(dump), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Errorf("Expected imported: %d Actual: %d", 1000, n)
+	}
+	src.Range(func(id *UUID, h []byte) error {
+		h2, _ := dst.Load(id)
+		if !bytes.Equal(h, h2) {
+			t.Errorf("Job ID %s: Expected: %x Actual: %x", id.MarshalText(), h, h2)
+		}
+		return nil
+	})
+
+	//truncated dumps must be rejected
+	if _, err := ImportHashStore(NewMemHashStore(1), bytes.NewReader(dump[:len(dump)-10]), 0, nil); err == nil {
+		t.Error("Expected truncated dump to be rejected")
+	}
+}
+
+func TestDumpRoundTripJSON(t *testing.T) {
+	testDumpRoundTrip(t, DumpFormatJSON)
+}
+
+func TestDumpRoundTripBinary(t *testing.T) {
+	testDumpRoundTrip(t, DumpFormatBinary)
+}
+
+func TestDumpChecksum(t *testing.T) {
+	src := NewMemHashStore(1)
+	u, _ := UUIDv4()
+	src.Store(u, []byte{0xAA, 0xBB, 0xCC})
+	var buf bytes.Buffer
+	if _, err := ExportHashStore(src, &buf, DumpFormatBinary, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.Bytes()
+	//flip a bit in the hash (after magic, version, tag, ID and length)
+	dump[len(dumpMagic)+1+1+16+1] ^= 0x01
+	if _, err := ImportHashStore(NewMemHashStore(1), bytes.NewReader(dump), 0, nil); err != ErrDumpChecksum {
+		t.Errorf("Expected: %v Actual: %v", ErrDumpChecksum, err)
+	}
+}
@@ -0,0 +1,306 @@
+package jumphasher
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Size of an AES-256 key in bytes
+const EncryptionKeySize = 32
+
+//Version tag prepended to sealed values so we can change the layout later
+const sealedVersion byte = 1
+
+//version (1) + key ID (4)
+const sealedHeaderSize = 5
+
+var ErrUnknownKeyID error = errors.New("encountered unknown encryption key ID")
+var ErrMalformedCiphertext error = errors.New("encountered malformed ciphertext")
+var ErrEmptyKeyring error = errors.New("keyring does not contain any keys")
+
+//Set of AES-256-GCM keys indexed by key ID
+//
+//The key with the highest ID is the active key and is used to seal new values.
+//Older keys are kept around so values sealed under them can still be opened (and re-encrypted)
+type Keyring struct {
+	keys   map[uint32]cipher.AEAD
+	active uint32
+	lock   sync.RWMutex
+}
+
+//Creates a new empty Keyring
+func NewKeyring() *Keyring {
+	var k Keyring
+	k.keys = make(map[uint32]cipher.AEAD)
+	return &k
+}
+
+//Loads a Keyring from a keyfile
+//
+//Each non-empty line that doesn't start with '#' holds a key ID and a hex encoded 32 byte key separated by a colon.
+//Eg; 3:8c1f...
+func LoadKeyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	k := NewKeyring()
+	s := bufio.NewScanner(f)
+	lineNo := 0
+	for s.Scan() {
+		lineNo++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("keyfile %s line %d: expected <key id>:<hex key>", path, lineNo)
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("keyfile %s line %d: invalid key ID: %s", path, lineNo, err.Error())
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("keyfile %s line %d: invalid key: %s", path, lineNo, err.Error())
+		}
+		err = k.AddKey(uint32(id), key)
+		if err != nil {
+			return nil, fmt.Errorf("keyfile %s line %d: %s", path, lineNo, err.Error())
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if k.Len() == 0 {
+		return nil, ErrEmptyKeyring
+	}
+	return k, nil
+}
+
+//Adds a 32 byte AES-256 key to the keyring under the given key ID
+//
+//If id is higher than any existing key ID, the key becomes the active key
+func (k *Keyring) AddKey(id uint32, key []byte) error {
+	if len(key) != EncryptionKeySize {
+		return fmt.Errorf("encryption key must be %d bytes, got %d", EncryptionKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, exists := k.keys[id]; exists {
+		return fmt.Errorf("duplicate encryption key ID %d", id)
+	}
+	if len(k.keys) == 0 || id > k.active {
+		k.active = id
+	}
+	k.keys[id] = aead
+	return nil
+}
+
+//Returns the ID of the key used to seal new values
+func (k *Keyring) ActiveKeyID() uint32 {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.active
+}
+
+//Returns the number of keys in the keyring
+func (k *Keyring) Len() int {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return len(k.keys)
+}
+
+//Seals plaintext under the active key, binding ad as additional authenticated data
+//
+//Output layout is version (1 byte) | key ID (4 bytes, big endian) | nonce | ciphertext + GCM tag
+func (k *Keyring) Seal(plaintext []byte, ad []byte) ([]byte, error) {
+	k.lock.RLock()
+	id := k.active
+	aead, exists := k.keys[id]
+	k.lock.RUnlock()
+	if !exists {
+		return nil, ErrEmptyKeyring
+	}
+	out := make([]byte, sealedHeaderSize+aead.NonceSize(), sealedHeaderSize+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	out[0] = sealedVersion
+	binary.BigEndian.PutUint32(out[1:sealedHeaderSize], id)
+	nonce := out[sealedHeaderSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, plaintext, ad), nil
+}
+
+//Opens a value produced by Seal, returning the plaintext and the ID of the key it was sealed under
+func (k *Keyring) Open(sealed []byte, ad []byte) ([]byte, uint32, error) {
+	if len(sealed) < sealedHeaderSize || sealed[0] != sealedVersion {
+		return nil, 0, ErrMalformedCiphertext
+	}
+	id := binary.BigEndian.Uint32(sealed[1:sealedHeaderSize])
+	k.lock.RLock()
+	aead, exists := k.keys[id]
+	k.lock.RUnlock()
+	if !exists {
+		return nil, id, ErrUnknownKeyID
+	}
+	if len(sealed) < sealedHeaderSize+aead.NonceSize()+aead.Overhead() {
+		return nil, id, ErrMalformedCiphertext
+	}
+	nonce := sealed[sealedHeaderSize : sealedHeaderSize+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, sealed[sealedHeaderSize+aead.NonceSize():], ad)
+	if err != nil {
+		return nil, id, err
+	}
+	return plaintext, id, nil
+}
+
+//HashStore decorator which seals hashes with AES-256-GCM before they reach the underlying store
+//
+//The job ID is bound in as additional authenticated data, so a sealed value can't be swapped between jobs
+//
+//Watchers are tracked here rather than in the underlying store so they receive opened hashes
+type EncryptedHashStore struct {
+	store HashStore
+	keys  *Keyring
+	watch *WatchList
+}
+
+//Creates a new EncryptedHashStore wrapping s
+func NewEncryptedHashStore(s HashStore, keys *Keyring) *EncryptedHashStore {
+	var e EncryptedHashStore
+	e.store = s
+	e.keys = keys
+	e.watch = NewWatchList(16)
+	return &e
+}
+
+//Seal and store a hash given a job ID
+func (e *EncryptedHashStore) Store(id *UUID, h []byte) error {
+	if id == nil {
+		return ErrNilJobID
+	}
+	sealed, err := e.keys.Seal(h, id[:])
+	if err != nil {
+		return err
+	}
+	if err := e.store.Store(id, sealed); err != nil {
+		return err
+	}
+	e.watch.Notify(id, h, nil)
+	return nil
+}
+
+//Load and open a hash given a job ID
+//
+//If it cannot be found, we return a nil slice
+func (e *EncryptedHashStore) Load(id *UUID) ([]byte, error) {
+	if id == nil {
+		return nil, ErrNilJobID
+	}
+	sealed, err := e.store.Load(id)
+	if err != nil || sealed == nil {
+		return nil, err
+	}
+	h, _, err := e.keys.Open(sealed, id[:])
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+//Iterate over every stored job ID and its opened hash
+func (e *EncryptedHashStore) Range(f func(id *UUID, h []byte) error) error {
+	return e.store.Range(func(id *UUID, sealed []byte) error {
+		h, _, err := e.keys.Open(sealed, id[:])
+		if err != nil {
+			return fmt.Errorf("could not open hash for job %s: %s", id.MarshalText(), err.Error())
+		}
+		return f(id, h)
+	})
+}
+
+//Watch for a hash to be stored for a job ID
+func (e *EncryptedHashStore) Watch(id *UUID) (<-chan Result, error) {
+	return e.watch.Watch(id, e.Load)
+}
+
+//Release a watcher returned by Watch
+func (e *EncryptedHashStore) Unwatch(id *UUID, c <-chan Result) {
+	e.watch.Remove(id, c)
+}
+
+//Returns the wrapped store
+func (e *EncryptedHashStore) Unwrap() HashStore {
+	return e.store
+}
+
+//Returns the keys hashes are sealed with
+func (e *EncryptedHashStore) Keyring() *Keyring {
+	return e.keys
+}
+
+//Closes the underlying store if it needs closing
+func (e *EncryptedHashStore) Close() error {
+	if c, ok := e.store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+//Re-encrypts the value for a job ID under the active key
+//
+//Returns true if the value was rewritten, false if it was missing or already sealed under the active key
+func (e *EncryptedHashStore) Reencrypt(id *UUID) (bool, error) {
+	if id == nil {
+		return false, ErrNilJobID
+	}
+	sealed, err := e.store.Load(id)
+	if err != nil || sealed == nil {
+		return false, err
+	}
+	h, keyID, err := e.keys.Open(sealed, id[:])
+	if err != nil {
+		return false, err
+	}
+	if keyID == e.keys.ActiveKeyID() {
+		return false, nil
+	}
+	return true, e.Store(id, h)
+}
+
+//Re-encrypts every value not sealed under the active key
+//
+//Returns the number of values rewritten
+func (e *EncryptedHashStore) ReencryptAll() (int, error) {
+	n := 0
+	err := e.store.Range(func(id *UUID, sealed []byte) error {
+		changed, err := e.Reencrypt(id)
+		if changed {
+			n++
+		}
+		return err
+	})
+	return n, err
+}
@@ -0,0 +1,144 @@
+package jumphasher
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+//generates a random AES-256 key
+func testKey(t *testing.T) []byte {
+	k := make([]byte, EncryptionKeySize)
+	if _, err := rand.Read(k); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestLoadKeyring(t *testing.T) {
+	f, err := ioutil.TempFile("", "jumphasher-keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "# rotated 2017-04-01\n1:%s\n\n7:%s\n", hex.EncodeToString(testKey(t)), hex.EncodeToString(testKey(t)))
+	f.Close()
+
+	k, err := LoadKeyring(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Len() != 2 {
+		t.Errorf("Expected keys: %d Actual: %d", 2, k.Len())
+	}
+	if k.ActiveKeyID() != 7 {
+		t.Errorf("Expected active key ID: %d Actual: %d", 7, k.ActiveKeyID())
+	}
+
+	//malformed keys must be rejected
+	f2, err := ioutil.TempFile("", "jumphasher-keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f2.Name())
+	fmt.Fprintf(f2, "1:deadbeef\n")
+	f2.Close()
+	if _, err := LoadKeyring(f2.Name()); err == nil {
+		t.Error("Expected short key to be rejected")
+	}
+}
+
+func TestEncryptedHashStoreStoreLoad(t *testing.T) {
+	k := NewKeyring()
+	if err := k.AddKey(1, testKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	inner := NewMemHashStore(4)
+	s := NewEncryptedHashStore(inner, k)
+
+	id, err := UUIDv4()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := NewSHA512Engine().Hash([]byte("hunter2"))
+	if err := s.Store(id, h); err != nil {
+		t.Fatal(err)
+	}
+
+	//underlying store must never see the plaintext hash
+	raw, _ := inner.Load(id)
+	if bytes.Contains(raw, h) {
+		t.Error("Underlying store contains plaintext hash")
+	}
+
+	h2, err := s.Load(id)
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(h, h2) {
+		t.Errorf("Expected: %x Actual: %x", h, h2)
+	}
+
+	//sealed value moved to a different job ID must fail authentication
+	id2, _ := UUIDv4()
+	inner.Store(id2, raw)
+	if _, err := s.Load(id2); err == nil {
+		t.Error("Expected sealed value bound to another job ID to fail authentication")
+	}
+
+	//missing job IDs should still give a nil slice
+	id3, _ := UUIDv4()
+	h3, err := s.Load(id3)
+	if err != nil {
+		t.Error(err)
+	} else if h3 != nil {
+		t.Error("Expected nil hash for missing job ID")
+	}
+}
+
+func TestEncryptedHashStore_Reencrypt(t *testing.T) {
+	k := NewKeyring()
+	if err := k.AddKey(1, testKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	inner := NewMemHashStore(4)
+	s := NewEncryptedHashStore(inner, k)
+	id, _ := UUIDv4()
+	h := []byte("not really a hash")
+	if err := s.Store(id, h); err != nil {
+		t.Fatal(err)
+	}
+
+	//nothing to do while the key hasn't rotated
+	changed, err := s.Reencrypt(id)
+	if err != nil {
+		t.Error(err)
+	} else if changed {
+		t.Error("Value already sealed under the active key should not be rewritten")
+	}
+
+	if err := k.AddKey(2, testKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	changed, err = s.Reencrypt(id)
+	if err != nil {
+		t.Error(err)
+	} else if !changed {
+		t.Error("Expected value to be rewritten under the new key")
+	}
+	raw, _ := inner.Load(id)
+	if _, keyID, err := k.Open(raw, id[:]); err != nil {
+		t.Error(err)
+	} else if keyID != 2 {
+		t.Errorf("Expected key ID: %d Actual: %d", 2, keyID)
+	}
+	h2, err := s.Load(id)
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(h, h2) {
+		t.Errorf("Expected: %x Actual: %x", h, h2)
+	}
+}
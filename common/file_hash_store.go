@@ -0,0 +1,172 @@
+package jumphasher
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+//job ID (16) + hash length (4)
+const fileRecordHeaderSize = 20
+
+//Upper bound on a single stored hash so a corrupt length can't make us allocate gigabytes on replay
+const maxFileRecordSize = 1 << 20
+
+var ErrHashTooLarge error = errors.New("hash exceeds maximum storable size")
+var ErrCorruptHashLog error = errors.New("hash log is corrupt before its last record")
+
+//Durable hash store backed by an append-only log file
+//
+//Every Store appends a record of job ID (16 bytes) | hash length (4 bytes, little endian) | hash.
+//On open the log is replayed into an in-memory index which serves all reads.
+//A torn record at the tail (eg; from a crash mid-write) is truncated away. A bad record anywhere else is an error,
+//since truncating there would discard every record after it
+type FileHashStore struct {
+	index *MemHashStore
+	f     *os.File
+	lock  sync.Mutex //serializes appends to f
+}
+
+//Opens (or creates) a FileHashStore at path
+//
+//size: number of buckets to use for the in-memory index
+func OpenFileHashStore(path string, size int) (*FileHashStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	var s FileHashStore
+	s.f = f
+	s.index = NewMemHashStore(size)
+	good, err := s.replay()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	//drop any torn record at the tail and position ourselves for appends
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &s, nil
+}
+
+//Replays the log into the index, returning the offset just past the last complete record
+//
+//Only a record cut short by the end of the file is treated as torn
+func (s *FileHashStore) replay() (int64, error) {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(s.f)
+	var good int64
+	var hdr [fileRecordHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return good, nil
+			}
+			return 0, err
+		}
+		n := binary.LittleEndian.Uint32(hdr[16:])
+		if n > maxFileRecordSize {
+			//Store never writes such a length, so this isn't a torn write
+			return 0, ErrCorruptHashLog
+		}
+		h := make([]byte, n)
+		if _, err := io.ReadFull(r, h); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return good, nil
+			}
+			return 0, err
+		}
+		var id UUID
+		copy(id[:], hdr[:16])
+		s.index.Store(&id, h)
+		good += int64(fileRecordHeaderSize) + int64(n)
+	}
+}
+
+//Append a hash to the log and index it
+func (s *FileHashStore) Store(id *UUID, h []byte) error {
+	if id == nil {
+		return ErrNilJobID
+	}
+	if len(h) > maxFileRecordSize {
+		return ErrHashTooLarge
+	}
+	rec := make([]byte, fileRecordHeaderSize+len(h))
+	copy(rec, id[:])
+	binary.LittleEndian.PutUint32(rec[16:], uint32(len(h)))
+	copy(rec[fileRecordHeaderSize:], h)
+
+	//index under the lock too, so concurrent stores to one ID leave the index agreeing with the last record on disk
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := s.f.Write(rec); err != nil {
+		return err
+	}
+	return s.index.Store(id, h)
+}
+
+//Load a hash given a job ID
+//
+//If it cannot be found, we return a nil slice
+func (s *FileHashStore) Load(id *UUID) ([]byte, error) {
+	return s.index.Load(id)
+}
+
+//Iterate over every stored job ID and hash
+func (s *FileHashStore) Range(f func(id *UUID, h []byte) error) error {
+	return s.index.Range(f)
+}
+
+//Watch for a hash to be stored for a job ID
+func (s *FileHashStore) Watch(id *UUID) (<-chan Result, error) {
+	return s.index.Watch(id)
+}
+
+//Release a watcher returned by Watch
+func (s *FileHashStore) Unwatch(id *UUID, c <-chan Result) {
+	s.index.Unwatch(id, c)
+}
+
+//Resizes the in-memory index
+func (s *FileHashStore) Resize(size int) error {
+	return s.index.Resize(size)
+}
+
+//Returns the number of buckets in the in-memory index
+func (s *FileHashStore) Size() int {
+	return s.index.Size()
+}
+
+//Returns true while the in-memory index is being resized
+func (s *FileHashStore) Resizing() bool {
+	return s.index.Resizing()
+}
+
+//Flushes the log to stable storage
+func (s *FileHashStore) Sync() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.f.Sync()
+}
+
+//Flushes and closes the log. The store must not be used afterwards
+func (s *FileHashStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.f.Sync(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
@@ -0,0 +1,146 @@
+package jumphasher
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestFileHashStoreStoreLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jumphasher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hashes.log")
+
+	s, err := OpenFileHashStore(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	he := NewSHA512Engine()
+	ids := make([]UUID, 100)
+	for i := range ids {
+		u, _ := UUIDv4()
+		ids[i] = *u
+		h, _ := he.Hash(u[:])
+		if err := s.Store(u, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//simulate a crash mid-write by appending a torn record
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{1, 2, 3, 4, 5})
+	f.Close()
+
+	//everything should survive a reopen
+	s, err = OpenFileHashStore(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := range ids {
+		h, err := s.Load(&ids[i])
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		expected, _ := he.Hash(ids[i][:])
+		if !bytes.Equal(h, expected) {
+			t.Errorf("Job ID %s: Expected: %x Actual: %x", ids[i].MarshalText(), expected, h)
+		}
+	}
+
+	//appends after recovery must land after the last good record
+	u, _ := UUIDv4()
+	if err := s.Store(u, []byte("after recovery")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	s, err = OpenFileHashStore(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if h, _ := s.Load(u); string(h) != "after recovery" {
+		t.Errorf("Expected: %s Actual: %s", "after recovery", h)
+	}
+}
+
+func TestFileHashStoreCorruptRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jumphasher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hashes.log")
+
+	s, err := OpenFileHashStore(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		u, _ := UUIDv4()
+		if err := s.Store(u, []byte("hash")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	//an implausible length on the first record is corruption, not a torn tail
+	f, _ := os.OpenFile(path, os.O_WRONLY, 0600)
+	f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 16)
+	f.Close()
+	before, _ := os.Stat(path)
+	if _, err := OpenFileHashStore(path, 4); err != ErrCorruptHashLog {
+		t.Errorf("Expected: %v Actual: %v", ErrCorruptHashLog, err)
+	}
+	if after, _ := os.Stat(path); after.Size() != before.Size() {
+		t.Errorf("Corrupt log was truncated from %d to %d bytes", before.Size(), after.Size())
+	}
+}
+
+//Whichever concurrent store to an ID wins, a restart must load the same hash
+func TestFileHashStoreConcurrentRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jumphasher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hashes.log")
+
+	s, err := OpenFileHashStore(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := UUIDv4()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			for n := 0; n < 100; n++ {
+				s.Store(u, []byte(fmt.Sprintf("hash %d", i)))
+			}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	before, _ := s.Load(u)
+	s.Close()
+	s, err = OpenFileHashStore(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if after, _ := s.Load(u); !bytes.Equal(before, after) {
+		t.Errorf("Expected: %s Actual: %s", before, after)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"sync"
+	"sync/atomic"
 )
 
 var ErrNilJobID error = errors.New("encountered nil job ID")
@@ -11,6 +12,7 @@ var ErrNilJobID error = errors.New("encountered nil job ID")
 //we could extend this with alternative hash stores
 const (
 	HashStoreTypeMem = iota
+	HashStoreTypeFile
 )
 
 //Implements a generic way to store and load job IDs and their corresponding hashes
@@ -19,47 +21,143 @@ const (
 type HashStore interface {
 	Store(id *UUID, h []byte) error
 	Load(id *UUID) ([]byte, error)
+	//Calls f for every stored job ID and hash, stopping at the first error f returns
+	//
+	//Items stored concurrently with Range may or may not be visited
+	Range(f func(id *UUID, h []byte) error) error
+	//Returns a channel that receives a single Result once a hash is stored for id,
+	//or immediately if it's already present
+	//
+	//Callers that stop waiting before the Result arrives must call Unwatch so the watcher can be released
+	Watch(id *UUID) (<-chan Result, error)
+	//Releases a watcher returned by Watch
+	Unwatch(id *UUID, c <-chan Result)
+}
+
+//Implemented by stores whose bucket count can be changed at runtime
+type ResizableHashStore interface {
+	HashStore
+	//Rehashes the store into size buckets, blocking until migration completes
+	Resize(size int) error
+	//Returns the current number of buckets
+	Size() int
+	//Returns true while a Resize is migrating items
+	Resizing() bool
+}
+
+var ErrResizeInProgress error = errors.New("store is already being resized")
+//Most buckets a MemHashStore may be resized to. Each one is a map and a lock, so far more would exhaust memory
+const MaxStoreSize = 1 << 20
+
+var ErrInvalidStoreSize error = errors.New("store size must be between 1 and 1048576")
+
+//A set of buckets and their locks
+//
+//Bucket locks are reader/writer locks so GET-heavy workloads don't serialize behind each other,
+//only behind writers to the same bucket
+type memTable struct {
+	buckets []map[UUID][]byte
+	drained []bool //set once a resize has migrated a bucket away. Guarded by the bucket's lock
+	locks   []sync.RWMutex
+}
+
+func newMemTable(size int) *memTable {
+	var t memTable
+	t.buckets = make([]map[UUID][]byte, size)
+	for i := range t.buckets {
+		t.buckets[i] = make(map[UUID][]byte)
+	}
+	t.drained = make([]bool, size)
+	t.locks = make([]sync.RWMutex, size)
+	return &t
+}
+
+//The tables a MemHashStore is using. Replaced wholesale, never modified
+type memTables struct {
+	cur *memTable //table all stores go to
+	old *memTable //table being drained by a resize, nil otherwise
+}
+
+//calculate bucket
+func (t *memTable) slot(id *UUID) int {
+	head := binary.LittleEndian.Uint32(id[0:4])
+	return int(head % uint32(len(t.buckets)))
 }
 
 //In-memory hash store using granular locking to prevent contention
 //
+//Loads only take shared locks, so readers never block each other
+//
 //Items are routed to a bucket based on first 4 bytes of job ID
 //
-//Ideally, we size this to the hardware concurrency of the machine
+//Ideally, we size this to the hardware concurrency of the machine.
+//The bucket count can be changed at runtime with Resize, which rehashes incrementally one bucket at a time
+//so loads and stores keep working during migration
+//
+//The tables are swapped atomically, so loads and stores share no lock beyond their bucket's. One that raced a swap
+//finds its bucket drained and retries against the new tables
 type MemHashStore struct {
-	buckets []map[UUID][]byte
-	locks   []sync.Mutex
+	tables atomic.Value //*memTables
+	resize sync.Mutex   //serializes resizes and migration steps against each other and against Range
+	watch  *WatchList   //pending watchers, notified on Store
 }
 
 //Creates a new MemHashStore object
 func NewMemHashStore(size int) *MemHashStore {
 	var m MemHashStore
-	m.buckets = make([]map[UUID][]byte, size)
-	for i := range m.buckets {
-		m.buckets[i] = make(map[UUID][]byte)
-	}
-	m.locks = make([]sync.Mutex, size)
+	m.tables.Store(&memTables{cur: newMemTable(size)})
+	m.watch = NewWatchList(size)
 	return &m
 }
 
+func (m *MemHashStore) current() *memTables {
+	return m.tables.Load().(*memTables)
+}
+
 //Store a hash given a job ID
 func (m *MemHashStore) Store(id *UUID, h []byte) error {
 	if id == nil {
 		return ErrNilJobID
 	}
-	//calculate bucket
-	head := binary.LittleEndian.Uint32(id[0:4])
-	slot := int(head) % len(m.buckets)
+	for {
+		tables := m.current()
+		t := tables.cur
+		slot := t.slot(id)
 
-	//lock the corresponding bucket
-	m.locks[slot].Lock()
-	//store the item
-	m.buckets[slot][*id] = h
-	//unlock the corresponding bucket
-	m.locks[slot].Unlock()
+		//lock the corresponding bucket
+		t.locks[slot].Lock()
+		if t.drained[slot] {
+			//a resize started since we looked
+			t.locks[slot].Unlock()
+			continue
+		}
+		//store the item
+		t.buckets[slot][*id] = h
+		//unlock the corresponding bucket
+		t.locks[slot].Unlock()
+		//an older value still waiting to be migrated must not be served or visited by Range
+		if old := tables.old; old != nil {
+			slot := old.slot(id)
+			old.locks[slot].Lock()
+			delete(old.buckets[slot], *id)
+			old.locks[slot].Unlock()
+		}
+		break
+	}
+	m.watch.Notify(id, h, nil)
 	return nil
 }
 
+//Watch for a hash to be stored for a job ID
+func (m *MemHashStore) Watch(id *UUID) (<-chan Result, error) {
+	return m.watch.Watch(id, m.Load)
+}
+
+//Release a watcher returned by Watch
+func (m *MemHashStore) Unwatch(id *UUID, c <-chan Result) {
+	m.watch.Remove(id, c)
+}
+
 //Load a hash given a job ID
 //
 //If it cannot be found, we return a nil slice
@@ -67,20 +165,127 @@ func (m *MemHashStore) Load(id *UUID) ([]byte, error) {
 	if id == nil {
 		return nil, ErrNilJobID
 	}
+	for {
+		tables := m.current()
+		//during a resize we must check the old table first.
+		//Migration copies an item into the new table before removing it from the old one,
+		//so if it's gone from the old table by the time we look, it's guaranteed to be in the new one.
+		//Store removes the old table's copy after storing a newer value, so that copy is never stale for long
+		if tables.old != nil {
+			if h, exists, _ := tables.old.load(id); exists {
+				return h, nil
+			}
+		}
+		h, exists, drained := tables.cur.load(id)
+		if drained {
+			//a resize started since we looked
+			continue
+		}
+		if exists {
+			return h, nil
+		}
+		return nil, nil
+	}
+}
 
-	//calculate bucket
-	head := binary.LittleEndian.Uint32(id[0:4])
-	slot := int(head) % len(m.buckets)
-
-	//lock the corresponding bucket
-	m.locks[slot].Lock()
+//Returns the item for id, whether it exists and whether its bucket has been migrated away
+func (t *memTable) load(id *UUID) ([]byte, bool, bool) {
+	slot := t.slot(id)
+	//share the corresponding bucket with other readers
+	t.locks[slot].RLock()
 	//load the item
-	h, exists := m.buckets[slot][*id]
+	h, exists := t.buckets[slot][*id]
+	drained := t.drained[slot]
 	//unlock the corresponding bucket
-	m.locks[slot].Unlock()
+	t.locks[slot].RUnlock()
+	return h, exists, drained
+}
 
-	if !exists {
-		return nil, nil
+//Iterate over every stored job ID and hash
+//
+//Buckets are snapshotted one at a time so f runs without holding any bucket locks.
+//Any in-progress resize is paused for the duration so items are visited exactly once
+func (m *MemHashStore) Range(f func(id *UUID, h []byte) error) error {
+	m.resize.Lock()
+	defer m.resize.Unlock()
+	current := m.current()
+	tables := []*memTable{current.cur}
+	if current.old != nil {
+		tables = append(tables, current.old)
 	}
-	return h, nil
+
+	type pair struct {
+		id UUID
+		h  []byte
+	}
+	var snap []pair
+	for _, t := range tables {
+		for slot := range t.buckets {
+			snap = snap[:0]
+			t.locks[slot].RLock()
+			for id, h := range t.buckets[slot] {
+				snap = append(snap, pair{id, h})
+			}
+			t.locks[slot].RUnlock()
+			for i := range snap {
+				if err := f(&snap[i].id, snap[i].h); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//Returns the current number of buckets
+func (m *MemHashStore) Size() int {
+	return len(m.current().cur.buckets)
+}
+
+//Returns true while a Resize is migrating items
+func (m *MemHashStore) Resizing() bool {
+	return m.current().old != nil
+}
+
+//Grows or shrinks the store to size buckets
+//
+//New items go straight to the new table while existing items are migrated one old bucket at a time.
+//Blocks until migration completes. Only one resize may run at a time
+func (m *MemHashStore) Resize(size int) error {
+	if size < 1 || size > MaxStoreSize {
+		return ErrInvalidStoreSize
+	}
+	m.resize.Lock()
+	if m.current().old != nil {
+		m.resize.Unlock()
+		return ErrResizeInProgress
+	}
+	old, cur := m.current().cur, newMemTable(size)
+	m.tables.Store(&memTables{cur: cur, old: old})
+	m.resize.Unlock()
+
+	for slot := range old.buckets {
+		//release between buckets so Range gets a look in
+		m.resize.Lock()
+		old.locks[slot].Lock()
+		for id, h := range old.buckets[slot] {
+			id := id
+			ns := cur.slot(&id)
+			cur.locks[ns].Lock()
+			//a concurrent Store always wins over the migrated value
+			if _, exists := cur.buckets[ns][id]; !exists {
+				cur.buckets[ns][id] = h
+			}
+			cur.locks[ns].Unlock()
+		}
+		old.buckets[slot] = make(map[UUID][]byte)
+		old.drained[slot] = true
+		old.locks[slot].Unlock()
+		m.resize.Unlock()
+	}
+
+	m.resize.Lock()
+	m.tables.Store(&memTables{cur: cur})
+	m.resize.Unlock()
+	return nil
 }
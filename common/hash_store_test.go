@@ -1,6 +1,9 @@
 package jumphasher
 
 import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
 	"runtime"
 	"sync"
 	"testing"
@@ -25,8 +28,8 @@ func TestMemHashStoreStoreLoad(t *testing.T) {
 	var wg sync.WaitGroup
 
 	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
 		go func(c chan *HashPair, g *sync.WaitGroup, s HashStore) {
-			g.Add(1)
 			for x := range c {
 				s.Store(&x.id, x.hash)
 			}
@@ -69,3 +72,239 @@ func TestMemHashStoreStoreLoad(t *testing.T) {
 		t.Errorf("Job ID %s not stored but was located in store", u2.MarshalText())
 	}
 }
+
+func TestMemHashStore_Range(t *testing.T) {
+	hs := NewMemHashStore(4)
+	stored := make(map[UUID][]byte)
+	for i := 0; i < 1000; i++ {
+		u, err := UUIDv4()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored[*u] = u[:4]
+		hs.Store(u, u[:4])
+	}
+	seen := 0
+	err := hs.Range(func(id *UUID, h []byte) error {
+		if _, exists := stored[*id]; !exists {
+			t.Errorf("Job ID %s visited but never stored", id.MarshalText())
+		}
+		seen++
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if seen != len(stored) {
+		t.Errorf("Expected visited: %d Actual: %d", len(stored), seen)
+	}
+
+	//errors must stop iteration
+	stop := errors.New("stop")
+	seen = 0
+	err = hs.Range(func(id *UUID, h []byte) error {
+		seen++
+		return stop
+	})
+	if err != stop || seen != 1 {
+		t.Errorf("Expected iteration to stop after first error. Visited: %d Error: %v", seen, err)
+	}
+}
+
+func TestMemHashStore_Resize(t *testing.T) {
+	hs := NewMemHashStore(2)
+	ids := make([]UUID, 50000)
+	for i := range ids {
+		u, err := UUIDv4()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = *u
+		hs.Store(u, u[:8])
+	}
+
+	//hammer the store with loads and stores while it migrates
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	fresh := make(chan UUID, 100000)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func(offset int) {
+			defer wg.Done()
+			for j := offset; ; j = (j + 1) % len(ids) {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				h, err := hs.Load(&ids[j])
+				if err != nil {
+					t.Error(err)
+				} else if h == nil {
+					t.Errorf("Job ID %s went missing during resize", ids[j].MarshalText())
+					return
+				}
+				if j%64 == 0 {
+					u, _ := UUIDv4()
+					hs.Store(u, u[:8])
+					select {
+					case fresh <- *u:
+					default:
+					}
+				}
+			}
+		}(i * 1000)
+	}
+	if err := hs.Resize(17); err != nil {
+		t.Error(err)
+	}
+	close(done)
+	wg.Wait()
+	close(fresh)
+
+	if hs.Size() != 17 {
+		t.Errorf("Expected size: %d Actual: %d", 17, hs.Size())
+	}
+	if hs.Resizing() {
+		t.Error("Store should not be resizing after Resize returns")
+	}
+	for i := range ids {
+		if h, _ := hs.Load(&ids[i]); h == nil {
+			t.Errorf("Job ID %s missing after resize", ids[i].MarshalText())
+		}
+	}
+	for u := range fresh {
+		if h, _ := hs.Load(&u); h == nil {
+			t.Errorf("Job ID %s stored during resize is missing", u.MarshalText())
+		}
+	}
+	count := 0
+	hs.Range(func(id *UUID, h []byte) error {
+		count++
+		return nil
+	})
+	if count < len(ids) {
+		t.Errorf("Expected at least %d items after resize, found %d", len(ids), count)
+	}
+
+	for _, size := range []int{0, MaxStoreSize + 1} {
+		if err := hs.Resize(size); err != ErrInvalidStoreSize {
+			t.Errorf("Size %d: Expected: %v Actual: %v", size, ErrInvalidStoreSize, err)
+		}
+	}
+}
+
+func TestMemHashStore_ResizeRestore(t *testing.T) {
+	hs := NewMemHashStore(4)
+	u, _ := UUIDv4()
+	hs.Store(u, []byte("stale"))
+
+	//freeze a resize before it migrates anything, as if it were mid-way
+	hs.tables.Store(&memTables{cur: newMemTable(7), old: hs.current().cur})
+	hs.Store(u, []byte("fresh"))
+	if h, _ := hs.Load(u); string(h) != "fresh" {
+		t.Errorf("Expected: fresh Actual: %s", h)
+	}
+	count := 0
+	hs.Range(func(id *UUID, h []byte) error {
+		count++
+		return nil
+	})
+	if count != 1 {
+		t.Errorf("Expected 1 item visited. Actual: %d", count)
+	}
+}
+
+//The MemHashStore read path as it was before loads took shared locks, kept as a baseline for benchmarks
+type exclusiveHashStore struct {
+	buckets []map[UUID][]byte
+	locks   []sync.Mutex
+}
+
+func newExclusiveHashStore(size int) *exclusiveHashStore {
+	var m exclusiveHashStore
+	m.buckets = make([]map[UUID][]byte, size)
+	for i := range m.buckets {
+		m.buckets[i] = make(map[UUID][]byte)
+	}
+	m.locks = make([]sync.Mutex, size)
+	return &m
+}
+
+func (m *exclusiveHashStore) Store(id *UUID, h []byte) error {
+	slot := int(binary.LittleEndian.Uint32(id[0:4])) % len(m.buckets)
+	m.locks[slot].Lock()
+	m.buckets[slot][*id] = h
+	m.locks[slot].Unlock()
+	return nil
+}
+
+func (m *exclusiveHashStore) Load(id *UUID) ([]byte, error) {
+	slot := int(binary.LittleEndian.Uint32(id[0:4])) % len(m.buckets)
+	m.locks[slot].Lock()
+	h := m.buckets[slot][*id]
+	m.locks[slot].Unlock()
+	return h, nil
+}
+
+func (m *exclusiveHashStore) Range(f func(id *UUID, h []byte) error) error {
+	return nil
+}
+
+func (m *exclusiveHashStore) Watch(id *UUID) (<-chan Result, error) {
+	return nil, nil
+}
+
+func (m *exclusiveHashStore) Unwatch(id *UUID, c <-chan Result) {}
+
+//Runs a parallel mixed workload where readPct percent of operations are loads of existing job IDs
+func benchmarkHashStoreMixed(b *testing.B, s HashStore, readPct int) {
+	ids := make([]UUID, 1<<16)
+	for i := range ids {
+		u, _ := UUIDv4()
+		ids[i] = *u
+		s.Store(u, u[:])
+	}
+	//pre-generate IDs for writes so we're not benchmarking crypto/rand
+	writes := make([]UUID, 1<<16)
+	for i := range writes {
+		u, _ := UUIDv4()
+		writes[i] = *u
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			n := r.Intn(len(ids))
+			if r.Intn(100) < readPct {
+				s.Load(&ids[n])
+			} else {
+				s.Store(&writes[n], writes[n][:])
+			}
+		}
+	})
+}
+
+func BenchmarkMemHashStore_Read50(b *testing.B) {
+	benchmarkHashStoreMixed(b, NewMemHashStore(runtime.NumCPU()), 50)
+}
+
+func BenchmarkMemHashStore_Read90(b *testing.B) {
+	benchmarkHashStoreMixed(b, NewMemHashStore(runtime.NumCPU()), 90)
+}
+
+func BenchmarkMemHashStore_Read99(b *testing.B) {
+	benchmarkHashStoreMixed(b, NewMemHashStore(runtime.NumCPU()), 99)
+}
+
+func BenchmarkExclusiveHashStore_Read50(b *testing.B) {
+	benchmarkHashStoreMixed(b, newExclusiveHashStore(runtime.NumCPU()), 50)
+}
+
+func BenchmarkExclusiveHashStore_Read90(b *testing.B) {
+	benchmarkHashStoreMixed(b, newExclusiveHashStore(runtime.NumCPU()), 90)
+}
+
+func BenchmarkExclusiveHashStore_Read99(b *testing.B) {
+	benchmarkHashStoreMixed(b, newExclusiveHashStore(runtime.NumCPU()), 99)
+}
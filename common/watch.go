@@ -0,0 +1,116 @@
+package jumphasher
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+//Outcome of a watched job, delivered once the job's hash is stored
+type Result struct {
+	ID   UUID
+	Hash []byte
+	Err  error
+}
+
+//Registry of watchers waiting on job IDs
+//
+//HashStore implementations embed one of these to implement Watch. Each watcher is a channel with a buffer of 1
+//that receives exactly one Result, so notifying never blocks and there's no goroutine per watcher.
+//Watchers are sharded by the first 4 bytes of the job ID, the same way MemHashStore routes items
+type WatchList struct {
+	shards []map[UUID][]chan Result
+	locks  []sync.Mutex
+}
+
+//Creates a new WatchList with size shards
+func NewWatchList(size int) *WatchList {
+	var w WatchList
+	w.shards = make([]map[UUID][]chan Result, size)
+	for i := range w.shards {
+		w.shards[i] = make(map[UUID][]chan Result)
+	}
+	w.locks = make([]sync.Mutex, size)
+	return &w
+}
+
+func (w *WatchList) slot(id *UUID) int {
+	return int(binary.LittleEndian.Uint32(id[0:4]) % uint32(len(w.shards)))
+}
+
+//Registers a watcher for id and returns its channel
+func (w *WatchList) Add(id *UUID) chan Result {
+	c := make(chan Result, 1)
+	slot := w.slot(id)
+	w.locks[slot].Lock()
+	w.shards[slot][*id] = append(w.shards[slot][*id], c)
+	w.locks[slot].Unlock()
+	return c
+}
+
+//Unregisters a watcher
+//
+//Returns false if it was no longer registered, i.e. it has already been (or is being) notified
+func (w *WatchList) Remove(id *UUID, c <-chan Result) bool {
+	slot := w.slot(id)
+	w.locks[slot].Lock()
+	defer w.locks[slot].Unlock()
+	cs := w.shards[slot][*id]
+	for i := range cs {
+		if cs[i] == c {
+			cs[i] = cs[len(cs)-1]
+			cs = cs[:len(cs)-1]
+			if len(cs) == 0 {
+				delete(w.shards[slot], *id)
+			} else {
+				w.shards[slot][*id] = cs
+			}
+			return true
+		}
+	}
+	return false
+}
+
+//Delivers a result to every watcher of id and unregisters them
+func (w *WatchList) Notify(id *UUID, h []byte, err error) {
+	slot := w.slot(id)
+	w.locks[slot].Lock()
+	cs := w.shards[slot][*id]
+	delete(w.shards[slot], *id)
+	w.locks[slot].Unlock()
+	for _, c := range cs {
+		c <- Result{ID: *id, Hash: h, Err: err}
+	}
+}
+
+//Returns the number of registered watchers
+func (w *WatchList) Len() int {
+	n := 0
+	for i := range w.shards {
+		w.locks[i].Lock()
+		for _, cs := range w.shards[i] {
+			n += len(cs)
+		}
+		w.locks[i].Unlock()
+	}
+	return n
+}
+
+//Generic Watch implementation for any store that calls Notify after every successful Store
+//
+//The watcher is registered before load is consulted, so a Store racing with Watch is never missed.
+//If the hash is already present, the returned channel is ready immediately
+func (w *WatchList) Watch(id *UUID, load func(id *UUID) ([]byte, error)) (<-chan Result, error) {
+	if id == nil {
+		return nil, ErrNilJobID
+	}
+	c := w.Add(id)
+	h, err := load(id)
+	if err == nil && h == nil {
+		return c, nil
+	}
+	//already available (or failed). Deliver ourselves unless a concurrent Store beat us to it
+	if w.Remove(id, c) {
+		c <- Result{ID: *id, Hash: h, Err: err}
+	}
+	return c, nil
+}
@@ -0,0 +1,103 @@
+package jumphasher
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemHashStore_Watch(t *testing.T) {
+	hs := NewMemHashStore(4)
+	u, _ := UUIDv4()
+	c, err := hs.Watch(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c:
+		t.Fatal("Watcher fired before the hash was stored")
+	default:
+	}
+	hs.Store(u, []byte("hash"))
+	select {
+	case r := <-c:
+		if !r.ID.Equals(u) || string(r.Hash) != "hash" || r.Err != nil {
+			t.Errorf("Unexpected result: %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Watcher did not fire after Store")
+	}
+
+	//watching something already stored fires immediately
+	c, _ = hs.Watch(u)
+	select {
+	case r := <-c:
+		if string(r.Hash) != "hash" {
+			t.Errorf("Expected: %s Actual: %s", "hash", r.Hash)
+		}
+	default:
+		t.Error("Watcher for stored hash should be ready immediately")
+	}
+
+	//abandoned watchers must be released
+	u2, _ := UUIDv4()
+	c, _ = hs.Watch(u2)
+	hs.Unwatch(u2, c)
+	if n := hs.watch.Len(); n != 0 {
+		t.Errorf("Expected watchers: %d Actual: %d", 0, n)
+	}
+
+	if _, err := hs.Watch(nil); err != ErrNilJobID {
+		t.Errorf("Expected: %v Actual: %v", ErrNilJobID, err)
+	}
+}
+
+//Races Watch against Store to make sure no notification is ever lost
+func TestMemHashStore_WatchRace(t *testing.T) {
+	hs := NewMemHashStore(4)
+	var wg sync.WaitGroup
+	for i := 0; i < 10000; i++ {
+		u, _ := UUIDv4()
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			hs.Store(u, u[:])
+		}()
+		go func() {
+			defer wg.Done()
+			c, _ := hs.Watch(u)
+			select {
+			case r := <-c:
+				if !bytes.Equal(r.Hash, u[:]) {
+					t.Errorf("Expected: %x Actual: %x", u[:], r.Hash)
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("Lost notification for job ID %s", u.MarshalText())
+			}
+		}()
+	}
+	wg.Wait()
+	if n := hs.watch.Len(); n != 0 {
+		t.Errorf("Expected watchers: %d Actual: %d", 0, n)
+	}
+}
+
+func TestEncryptedHashStore_Watch(t *testing.T) {
+	k := NewKeyring()
+	if err := k.AddKey(1, testKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	s := NewEncryptedHashStore(NewMemHashStore(4), k)
+	u, _ := UUIDv4()
+	c, _ := s.Watch(u)
+	s.Store(u, []byte("plaintext"))
+	select {
+	case r := <-c:
+		if string(r.Hash) != "plaintext" {
+			t.Errorf("Expected: %s Actual: %s", "plaintext", r.Hash)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Watcher did not fire after Store")
+	}
+}